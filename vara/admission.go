@@ -0,0 +1,124 @@
+package vara
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdmissionPolicy decides which remote stations are allowed to connect to a listener.
+//
+// Callsign patterns are matched case-insensitively, and may contain shell-style wildcards (see
+// path.Match). A pattern ending with "-*" also matches the callsign without SSID, so "N0CALL-*"
+// matches N0CALL, N0CALL-1 and N0CALL-10.
+type AdmissionPolicy struct {
+	// Allow lists the callsign patterns allowed to connect. If empty, any callsign not denied is allowed.
+	Allow []string
+	// Deny lists the callsign patterns never allowed to connect.
+	Deny []string
+	// Func is called for callers passing the allow and deny lists, allowing dynamic decisions.
+	// A non-nil error rejects the caller. Optional.
+	//
+	// It is called from the modem's command reader, and must return quickly.
+	Func func(call string) error
+	// RateLimit is the maximum number of connections accepted from a single callsign within RatePeriod.
+	// Zero means no limit. RatePeriod must be set along with RateLimit, or Listen fails.
+	RateLimit  int
+	RatePeriod time.Duration
+	// RejectFunc is called when a caller is rejected. Optional.
+	//
+	// It is called from the modem's command reader, and must return quickly.
+	RejectFunc func(call string, reason error)
+}
+
+// admission holds the state of an AdmissionPolicy used by a listener.
+type admission struct {
+	policy AdmissionPolicy
+
+	mu       sync.Mutex
+	admitted map[string][]time.Time // Recently admitted connections per callsign
+}
+
+func newAdmission(p AdmissionPolicy) *admission {
+	return &admission{policy: p, admitted: make(map[string][]time.Time)}
+}
+
+// admit decides if call is allowed to connect, returning an error wrapping ErrRejected if not.
+func (a *admission) admit(call string, now time.Time) error {
+	p := a.policy
+	if matchAny(p.Deny, call) {
+		return fmt.Errorf("%w: denied", ErrRejected)
+	}
+	if len(p.Allow) > 0 && !matchAny(p.Allow, call) {
+		return fmt.Errorf("%w: not allowed", ErrRejected)
+	}
+
+	key := strings.ToUpper(call)
+	if p.RateLimit > 0 && a.rateLimited(key, now, false) {
+		return fmt.Errorf("%w: rate limited", ErrRejected)
+	}
+	// Func is called without holding a.mu, as it may block or call back into the modem.
+	if p.Func != nil {
+		if err := p.Func(call); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+	if p.RateLimit > 0 && a.rateLimited(key, now, true) {
+		return fmt.Errorf("%w: rate limited", ErrRejected)
+	}
+	return nil
+}
+
+// rateLimited forgets the connections from key older than RatePeriod, and returns true if
+// RateLimit connections remain. Otherwise, the connection at now is recorded if record is set.
+func (a *admission) rateLimited(key string, now time.Time, record bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	recent := a.admitted[key][:0]
+	for _, t := range a.admitted[key] {
+		if now.Sub(t) < a.policy.RatePeriod {
+			recent = append(recent, t)
+		}
+	}
+	a.admitted[key] = recent
+	if len(recent) >= a.policy.RateLimit {
+		return true
+	}
+	if record {
+		a.admitted[key] = append(recent, now)
+	}
+	return false
+}
+
+// reject disconnects a caller rejected by the admission policy.
+func (m *Modem) reject(a *admission, call string, reason error) {
+	m.logger.Warn("VARA rejected inbound connection", "remote", call, "reason", reason)
+	m.setEndReason(EndRejected)
+	m.writeCmd("DISCONNECT")
+	if fn := a.policy.RejectFunc; fn != nil {
+		fn(call, reason)
+	}
+}
+
+func matchAny(patterns []string, call string) bool {
+	for _, p := range patterns {
+		if matchCall(p, call) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCall reports whether call matches the callsign pattern.
+func matchCall(pattern, call string) bool {
+	pattern, call = strings.ToUpper(pattern), strings.ToUpper(call)
+	if base := strings.TrimSuffix(pattern, "-*"); base != pattern {
+		if ok, _ := path.Match(base, call); ok {
+			return true // No SSID
+		}
+	}
+	ok, _ := path.Match(pattern, call)
+	return ok
+}
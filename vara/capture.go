@@ -0,0 +1,248 @@
+package vara
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture file format
+//
+// A capture is a UTF-8 text file with one record per line:
+//
+//	<timestamp> <tag> <payload>
+//
+// The timestamp is in RFC 3339 format with nanoseconds, in UTC. The tag gives the port and direction
+// of the record:
+//
+//	C>  command sent to VARA
+//	C<  command received from VARA
+//	D>  data written to VARA's data port
+//	D<  data read from VARA's data port
+//
+// The payload of a command record is the command without the trailing carriage return. The payload
+// of a data record is the chunk of data, exactly as written or read, in standard base64 encoding.
+//
+// Empty lines and lines starting with '#' are comments. Each file starts with a comment identifying
+// the format version and the modem:
+//
+//	# vara-capture 1 varahf N0CALL
+const captureVersion = 1
+
+// CaptureTag identifies the port and direction of a CaptureRecord.
+type CaptureTag string
+
+const (
+	CaptureCmdOut  CaptureTag = "C>" // Command sent to VARA
+	CaptureCmdIn   CaptureTag = "C<" // Command received from VARA
+	CaptureDataOut CaptureTag = "D>" // Data written to VARA
+	CaptureDataIn  CaptureTag = "D<" // Data read from VARA
+)
+
+// IsCmd returns true if the record belongs to the command port.
+func (t CaptureTag) IsCmd() bool { return t == CaptureCmdOut || t == CaptureCmdIn }
+
+// IsOut returns true if the record was sent to VARA.
+func (t CaptureTag) IsOut() bool { return t == CaptureCmdOut || t == CaptureDataOut }
+
+// CaptureRecord is a single record of a capture.
+type CaptureRecord struct {
+	Time time.Time
+	Tag  CaptureTag
+	// Payload is the command (without trailing carriage return) or data
+	Payload []byte
+}
+
+// CaptureConfig configures capturing of the traffic between the modem and VARA.
+type CaptureConfig struct {
+	// Path is the capture file. It's appended to if it exists.
+	Path string
+	// MaxSize is the size in bytes at which the file is rotated; defaults to 10 MiB
+	MaxSize int64
+	// MaxFiles is the number of rotated files kept (Path.1 being the most recent); defaults to 3
+	MaxFiles int
+}
+
+// capture writes capture records to a rotated file.
+type capture struct {
+	config CaptureConfig
+	header string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	err  error // Set if writing failed; capturing stops
+}
+
+func newCapture(config CaptureConfig, scheme, myCall string) (*capture, error) {
+	if config.MaxSize == 0 {
+		config.MaxSize = 10 << 20
+	}
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 3
+	}
+	c := &capture{
+		config: config,
+		header: fmt.Sprintf("# vara-capture %d %s %s\n", captureVersion, scheme, myCall),
+	}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *capture) open() error {
+	f, err := os.OpenFile(c.config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't open capture file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	c.file, c.size = f, fi.Size()
+	return c.write(c.header)
+}
+
+func (c *capture) write(line string) error {
+	n, err := io.WriteString(c.file, line)
+	c.size += int64(n)
+	return err
+}
+
+// rotate closes the current file, shifts the rotated files and opens a new file.
+func (c *capture) rotate() error {
+	c.file.Close()
+	path := c.config.Path
+	os.Remove(fmt.Sprintf("%s.%d", path, c.config.MaxFiles))
+	for i := c.config.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+	return c.open()
+}
+
+// record writes a record. If writing fails, the error is returned once and capturing stops.
+func (c *capture) record(t time.Time, tag CaptureTag, payload []byte) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	line := formatCaptureRecord(CaptureRecord{t, tag, payload})
+	if c.size > 0 && c.size+int64(len(line)) > c.config.MaxSize {
+		c.err = c.rotate()
+	}
+	if c.err == nil {
+		c.err = c.write(line)
+	}
+	return c.err
+}
+
+func (c *capture) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = os.ErrClosed
+	}
+	return c.file.Close()
+}
+
+func formatCaptureRecord(r CaptureRecord) string {
+	payload := string(r.Payload)
+	if !r.Tag.IsCmd() {
+		payload = base64.StdEncoding.EncodeToString(r.Payload)
+	}
+	return fmt.Sprintf("%s %s %s\n", r.Time.UTC().Format(time.RFC3339Nano), r.Tag, payload)
+}
+
+// captureRecord records traffic if capturing is enabled.
+func (m *Modem) captureRecord(tag CaptureTag, payload []byte) {
+	if err := m.capture.record(m.config.Clock.Now(), tag, payload); err != nil {
+		m.logger.Error("Capture failed, capturing stopped", "error", err)
+	}
+}
+
+// CaptureReader reads records from a capture.
+type CaptureReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewCaptureReader returns a CaptureReader reading the capture from r.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	return &CaptureReader{scanner: s}
+}
+
+// Next returns the next record. It returns io.EOF at the end of the capture.
+func (r *CaptureReader) Next() (CaptureRecord, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimRight(r.scanner.Text(), "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rec, err := parseCaptureRecord(line)
+		if err != nil {
+			return rec, fmt.Errorf("capture line %d: %w", r.line, err)
+		}
+		return rec, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return CaptureRecord{}, err
+	}
+	return CaptureRecord{}, io.EOF
+}
+
+// ReadAll returns all remaining records.
+func (r *CaptureReader) ReadAll() ([]CaptureRecord, error) {
+	var recs []CaptureRecord
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func parseCaptureRecord(line string) (CaptureRecord, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return CaptureRecord{}, fmt.Errorf("malformed record %q", line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return CaptureRecord{}, err
+	}
+	rec := CaptureRecord{Time: t, Tag: CaptureTag(parts[1])}
+	switch rec.Tag {
+	case CaptureCmdOut, CaptureCmdIn:
+		rec.Payload = []byte(parts[2])
+	case CaptureDataOut, CaptureDataIn:
+		if rec.Payload, err = base64.StdEncoding.DecodeString(parts[2]); err != nil {
+			return rec, err
+		}
+	default:
+		return rec, fmt.Errorf("unknown tag %q", parts[1])
+	}
+	return rec, nil
+}
@@ -0,0 +1,58 @@
+package vara
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vara.capture")
+	c, err := newCapture(CaptureConfig{Path: path, MaxSize: 120, MaxFiles: 2}, "varahf", "N0CALL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	recs := []CaptureRecord{
+		{start, CaptureCmdOut, []byte("CONNECT N0CALL LA5NTA")},
+		{start.Add(time.Second), CaptureCmdIn, []byte("CONNECTED N0CALL LA5NTA 2300")},
+		{start.Add(2 * time.Second), CaptureDataOut, []byte("[WL2K-5.0-B2FWIHJM$]\r")},
+		{start.Add(3 * time.Second), CaptureDataIn, []byte{0x00, 0xff, '\n', '\r'}},
+		{start.Add(4 * time.Second), CaptureCmdIn, []byte("DISCONNECTED")},
+	}
+	for _, r := range recs {
+		if err := c.record(r.Time, r.Tag, r.Payload); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	c.close()
+
+	// Each file holds a single record, and only two rotated files are kept.
+	var got []CaptureRecord
+	for _, p := range []string{path + ".2", path + ".1", path} {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), "# vara-capture 1 varahf N0CALL\n") {
+			t.Errorf("%s: missing header", p)
+		}
+		r, err := NewCaptureReader(bytes.NewReader(b)).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		got = append(got, r...)
+	}
+	recs = recs[2:]
+	if len(got) != len(recs) {
+		t.Fatalf("expected %d records, got %d", len(recs), len(got))
+	}
+	for i, r := range recs {
+		if !got[i].Time.Equal(r.Time) || got[i].Tag != r.Tag || !bytes.Equal(got[i].Payload, r.Payload) {
+			t.Errorf("record %d: got %+v, want %+v", i, got[i], r)
+		}
+	}
+}
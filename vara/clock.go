@@ -0,0 +1,54 @@
+package vara
+
+import "time"
+
+// Clock is the source of time and timers used by the modem.
+//
+// It can be replaced (see ModemConfig.Clock) to control the passing of time in tests. Network
+// I/O deadlines are always based on the system clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the Clock equivalent of time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered. It is nil for timers created by AfterFunc.
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// after waits for the duration to elapse and then sends the current time on the returned channel.
+//
+// Unlike time.After, the underlying timer is released when stop is called.
+func (m *Modem) after(d time.Duration) (c <-chan time.Time, stop func() bool) {
+	t := m.config.Clock.NewTimer(d)
+	return t.C(), t.Stop
+}
+
+// resetTimer stops, drains and resets a timer created with Clock.NewTimer.
+func resetTimer(t Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C():
+		default:
+		}
+	}
+	t.Reset(d)
+}
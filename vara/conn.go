@@ -1,8 +1,7 @@
 package vara
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -13,31 +12,42 @@ import (
 type conn struct {
 	*Modem
 	remoteCall string
+	session    *session
 
 	lastWrite time.Time
 	closeOnce sync.Once
 	closing   bool
+
+	writeMu     sync.Mutex    // Held while sending data and closing writeClosed
+	writeClosed chan struct{} // Closed by CloseWrite
 }
 
 func (m *Modem) newConn(remoteCall string) *conn {
-	m.dataConn.SetDeadline(time.Time{}) // Reset any previous deadlines
+	m.setDataWriteDeadline(time.Time{}) // Reset any previous deadline
 	return &conn{
-		Modem:      m,
-		remoteCall: remoteCall,
+		Modem:       m,
+		remoteCall:  remoteCall,
+		session:     m.currentSession(),
+		writeClosed: make(chan struct{}),
 	}
 }
 
 // Flush blocks until the modem's TX buffer is empty.
-func (v *conn) Flush() error {
-	debugPrint("Flushing...")
-	defer debugPrint("Flushed")
+func (v *conn) Flush() error { return v.FlushContext(context.Background()) }
+
+// FlushContext is like Flush, but returns ctx.Err() if the context is cancelled before the TX
+// buffer is empty.
+func (v *conn) FlushContext(ctx context.Context) error {
+	v.session.log.Debug("Flushing...")
+	defer v.session.log.Debug("Flushed")
 	cmds, cancel := v.cmds.Subscribe("DISCONNECTED", "BUFFER")
 	defer cancel()
 	if v.closing {
 		return nil
 	}
 
-	timeout := time.NewTimer(time.Minute)
+	start := v.config.Clock.Now()
+	timeout := v.config.Clock.NewTimer(v.config.Timing.BufferTimeout)
 	defer timeout.Stop()
 
 	count := v.bufferCount.get()
@@ -50,27 +60,29 @@ func (v *conn) Flush() error {
 			case cmd == "DISCONNECTED":
 				return io.EOF
 			default:
-				if !timeout.Stop() {
-					<-timeout.C
-				}
-				timeout.Reset(time.Minute)
+				resetTimer(timeout, v.config.Timing.BufferTimeout)
 				count = parseBuffer(cmd)
 			}
-		case <-timeout.C:
-			return errors.New("flush: buffer timeout")
+		case <-timeout.C():
+			return &OpError{Op: "flush", Target: v.remoteCall, Elapsed: v.config.Clock.Now().Sub(start), Err: ErrBufferStalled}
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 	return nil
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection.
-func (v *conn) SetDeadline(t time.Time) error { return v.dataConn.SetDeadline(t) }
+func (v *conn) SetDeadline(t time.Time) error {
+	v.session.rx.setDeadline(t)
+	return v.setDataWriteDeadline(t)
+}
 
 // SetWriteDeadline sets the write deadline associated with the connection.
-func (v *conn) SetWriteDeadline(t time.Time) error { return v.dataConn.SetWriteDeadline(t) }
+func (v *conn) SetWriteDeadline(t time.Time) error { return v.setDataWriteDeadline(t) }
 
 // SetReadDeadline sets the read deadline associated with the connection.
-func (v *conn) SetReadDeadline(t time.Time) error { return v.dataConn.SetReadDeadline(t) }
+func (v *conn) SetReadDeadline(t time.Time) error { v.session.rx.setDeadline(t); return nil }
 
 // LocalAddr returns the local network address.
 func (v *conn) LocalAddr() net.Addr { return Addr{v.myCall} }
@@ -81,24 +93,28 @@ func (v *conn) RemoteAddr() net.Addr { return Addr{v.remoteCall} }
 // Close closes the connection.
 //
 // Any blocked Read or Write operations will be unblocked and return errors.
-func (v *conn) Close() error {
+func (v *conn) Close() error { return v.CloseContext(context.Background()) }
+
+// CloseContext is like Close, but aborts the link and returns ctx.Err() if the context is
+// cancelled before the link is gracefully disconnected.
+func (v *conn) CloseContext(ctx context.Context) error {
 	var err error
 	v.closeOnce.Do(func() {
-		debugPrint("Closing connection...")
-		if v.Modem.closed {
+		v.session.log.Debug("Closing connection...")
+		start := v.config.Clock.Now()
+		if v.Modem.isClosed() {
 			err = ErrModemClosed
 			return
 		}
 		defer func() {
 			// Discard any remaining data
-			v.dataConn.SetReadDeadline(time.Now().Add(time.Second))
-			n, _ := io.Copy(io.Discard, v.dataConn)
-			debugPrint("close: discarded %d bytes of remaining data", n)
+			n := v.session.rx.discard(io.EOF)
+			v.session.log.Debug("Close discarded remaining data", "bytes", n)
 		}()
 		v.closing = true
 		connectChange, cancel := v.cmds.Subscribe("DISCONNECTED")
 		defer cancel()
-		if v.connectedState == disconnected {
+		if v.state() == disconnected {
 			// Connection is already closed.
 			return
 		}
@@ -107,11 +123,23 @@ func (v *conn) Close() error {
 		// (since cmd and data are not synchronized being on separate TCP sockets):
 		// VARA promise that DISCONNECT will flush the TX buffer before closing the connection, but we
 		// need to make sure the last data written have reached the modem before calling DISCONNECT.
-		if dur := time.Since(v.lastWrite); dur < 2*time.Second {
-			<-time.After(2*time.Second - dur)
+		if dur := v.config.Clock.Now().Sub(v.lastWrite); dur < v.config.Timing.WriteSettleTime {
+			settled, stop := v.after(v.config.Timing.WriteSettleTime - dur)
+			defer stop()
+			select {
+			case <-settled:
+			case <-ctx.Done():
+				v.session.log.Debug("Close cancelled, aborting connection")
+				v.Abort()
+				err = ctx.Err()
+				return
+			}
 		}
 
+		v.setEndReason(EndGraceful)
 		v.writeCmd("DISCONNECT")
+		timeout, stop := v.after(v.config.Timing.DisconnectTimeout)
+		defer stop()
 		select {
 		case _, ok := <-connectChange:
 			if !ok {
@@ -121,73 +149,50 @@ func (v *conn) Close() error {
 			// This is the happy path. Connection was gracefully closed.
 			err = nil
 			return
-		case <-time.After(60 * time.Second):
-			debugPrint("disconnect timeout - aborting connection")
+		case <-timeout:
+			v.session.log.Warn("Disconnect timeout, aborting connection")
+			v.setEndReason(EndTimeout)
+			v.Abort()
+			err = &OpError{Op: "close", Target: v.remoteCall, Elapsed: v.config.Clock.Now().Sub(start), Err: ErrDisconnectTimeout}
+			return
+		case <-ctx.Done():
+			v.session.log.Debug("Close cancelled, aborting connection")
 			v.Abort()
-			err = fmt.Errorf("disconnect timeout - connection aborted")
+			err = ctx.Err()
 			return
 		}
 	})
 	return err
 }
 
-func (v *conn) Read(b []byte) (n int, err error) {
-	connectChange, cancel := v.cmds.Subscribe("DISCONNECTED")
-	defer cancel()
-	if v.connectedState != connected {
-		debugPrint("read: not connected")
-		return 0, io.EOF
-	}
-
-	type res struct {
-		n   int
-		err error
+// CloseWrite shuts down the writing side of the connection, signaling that we're done sending.
+//
+// It blocks until the TX buffer is flushed. Subsequent writes fail, while Read keeps returning data
+// until the remote station disconnects. The link is not disconnected until Close is called, or the
+// remote station disconnects.
+func (v *conn) CloseWrite() error {
+	v.writeMu.Lock()
+	closed := v.isWriteClosed()
+	if !closed {
+		close(v.writeClosed) // Wakes writes waiting for buffer space
 	}
-	ready := make(chan res, 1)
-	go func() {
-		defer close(ready)
-		v.dataConn.SetReadDeadline(time.Time{}) // Disable read deadline
-		n, err = v.dataConn.Read(b)
-		if err != nil {
-			debugPrint("read error: %v", err)
-		}
-		ready <- res{n, err}
-	}()
-	select {
-	case res := <-ready:
-		// We got data. Return it :)
-		return res.n, res.err
-	case _, ok := <-connectChange:
-		debugPrint("read: disconnected while reading")
-		if !ok {
-			return 0, ErrModemClosed
-		}
-		// Workaround for race condition between cmd and data conn.
-		// The data was of course sent before the DISCONNECT, but they are received
-		// out of order since they're sent from the modem on independent streams.
-		select {
-		case res := <-ready:
-			debugPrint("read: got data (%d bytes) after disconnect (err: %v)", res.n, res.err)
-			if res.err != nil {
-				return res.n, io.EOF
-			}
-			return res.n, nil
-		case <-time.After(2 * time.Second):
-			debugPrint("read: timeout waiting for data after disconnect")
-			// Set a read deadline to ensure the above Read call is cancelled after we return.
-			v.dataConn.SetReadDeadline(time.Now())
-			return 0, io.EOF
-		}
+	v.writeMu.Unlock()
+	if closed {
+		return nil
 	}
+	v.session.log.Debug("Close write, flushing...")
+	return v.Flush()
 }
 
-func (v *conn) Write(b []byte) (int, error) {
-	cmds, cancel := v.cmds.Subscribe("DISCONNECTED", "BUFFER")
-	defer cancel()
-	if v.connectedState != connected {
-		return 0, io.EOF
-	}
+// Read reads data received from the remote station.
+//
+// Data is buffered per session by the modem's data port reader, so Read never blocks on the
+// underlying TCP connection. After the link is disconnected, any remaining data can still be read
+// before io.EOF is returned.
+func (v *conn) Read(b []byte) (int, error) { return v.session.rx.Read(b) }
 
+// Write writes data to the connection.
+func (v *conn) Write(b []byte) (int, error) {
 	// Throttle to match the transmitted data rate by blocking if the tx buffer size is getting much bigger
 	// than the payloads being sent.
 	//
@@ -197,31 +202,107 @@ func (v *conn) Write(b []byte) (int, error) {
 	// a very large TX buffer causing Close() to block for a very long time. This magic number seem to work
 	// well enough for both VARA FM and VARA HF.
 	const magicNumber = 7
+	return v.write(context.Background(), b, magicNumber*len(b))
+}
+
+// ReadFrom implements io.ReaderFrom, writing data read from r to the connection until EOF.
+//
+// Data is read from r in chunks sized for a couple of seconds of airtime at the negotiated bandwidth,
+// and the next chunk is not written until the TX buffer holds less than a chunk. This keeps the buffer
+// depth (and thereby the time needed to flush it) predictable during bulk transfers.
+func (v *conn) ReadFrom(r io.Reader) (int64, error) {
+	return v.ReadFromContext(context.Background(), r)
+}
+
+// ReadFromContext is like ReadFrom, but stops and returns ctx.Err() if the context is cancelled.
+//
+// Data already written to the modem is not affected by the cancellation.
+func (v *conn) ReadFromContext(ctx context.Context, r io.Reader) (n int64, err error) {
+	buf := make([]byte, v.chunkSize())
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := v.write(ctx, buf[:nr], len(buf))
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		switch {
+		case rerr == io.EOF:
+			return n, nil
+		case rerr != nil:
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, writing received data to w until the remote station disconnects.
+//
+// All data available at any time is written to w in a single call.
+func (v *conn) WriteTo(w io.Writer) (int64, error) { return v.session.rx.WriteTo(w) }
+
+// chunkSizes maps the negotiated bandwidth to the approximate number of bytes transferred during a
+// couple of seconds of airtime at the top speed of the mode.
+var chunkSizes = map[string]int{
+	"500":    512,
+	"2300":   2048,
+	"2750":   2048,
+	"NARROW": 4096,
+	"WIDE":   8192,
+}
+
+// chunkSize returns the chunk size used by ReadFrom.
+func (v *conn) chunkSize() int {
+	if n, ok := chunkSizes[v.session.bandwidth]; ok {
+		return n
+	}
+	return 2048
+}
+
+// write writes b to the modem, blocking until the TX buffer count is below limit.
+func (v *conn) write(ctx context.Context, b []byte, limit int) (int, error) {
+	cmds, cancel := v.cmds.Subscribe("DISCONNECTED", "BUFFER")
+	defer cancel()
+	if v.isWriteClosed() {
+		return 0, &OpError{Op: "write", Target: v.remoteCall, Err: net.ErrClosed}
+	}
+	if err := v.expired(); err != nil {
+		return 0, &OpError{Op: "write", Target: v.remoteCall, Err: err}
+	}
+	if v.state() != connected {
+		return 0, io.EOF
+	}
 
-	bufferTimeout := time.NewTimer(time.Minute)
+	start := v.config.Clock.Now()
+	bufferTimeout := v.config.Clock.NewTimer(v.config.Timing.BufferTimeout)
 	defer bufferTimeout.Stop()
 	bufferCount := v.bufferCount.get()
-	for bufferCount >= magicNumber*len(b) && !v.closing {
-		debugPrint("write: buffer full (%d >= %d)", bufferCount, magicNumber*len(b))
+	for bufferCount >= limit && !v.closing {
+		v.session.log.Debug("Write waiting for buffer space", "buffered", bufferCount, "limit", limit)
 		select {
 		case cmd, ok := <-cmds:
 			switch {
 			case !ok:
 				return 0, ErrModemClosed
 			case cmd == "DISCONNECTED":
-				debugPrint("write: state changed while waiting for buffer space")
+				v.session.log.Debug("State changed while waiting for buffer space")
 				return 0, io.EOF
 			default:
 				bufferCount = parseBuffer(cmd)
-				if !bufferTimeout.Stop() {
-					<-bufferTimeout.C
-				}
-				bufferTimeout.Reset(time.Minute)
+				resetTimer(bufferTimeout, v.config.Timing.BufferTimeout)
 			}
-		case <-bufferTimeout.C:
+		case <-bufferTimeout.C():
 			// This is most likely due to a app<->tnc bug, but might also be due
 			// to stalled connection.
-			return 0, fmt.Errorf("write: buffer timeout")
+			return 0, &OpError{Op: "write", Target: v.remoteCall, Elapsed: v.config.Clock.Now().Sub(start), Err: ErrBufferStalled}
+		case <-v.writeClosed:
+			return 0, &OpError{Op: "write", Target: v.remoteCall, Err: net.ErrClosed}
+		case <-ctx.Done():
+			return 0, ctx.Err()
 		}
 	}
 
@@ -229,23 +310,49 @@ func (v *conn) Write(b []byte) (int, error) {
 	// Since VARA keeps the connection open until the TX buffer is empty, we need to make sure we don't
 	// keep feeding the buffer after we've sent the DISCONNECT command.
 	// To do this, we block until the disconnect is complete.
-	if v.closing && v.connectedState == connected {
-		debugPrint("write: waiting for disconnect to complete...")
+	if v.closing && v.state() == connected {
+		v.session.log.Debug("Write waiting for disconnect to complete...")
 		for cmd := range cmds {
 			if cmd != "DISCONNECTED" {
 				continue
 			}
 			break
 		}
-		debugPrint("write: disconnect complete")
+		v.session.log.Debug("Disconnect complete")
 		return 0, io.EOF
 	}
 
 	// Modem is ready to receive more data :-)
-	debugPrint("write: sending %d bytes", len(b))
+	// CloseWrite may have been called while we were waiting. Hold writeMu while sending, so CloseWrite
+	// doesn't return before the data is flushed.
+	v.writeMu.Lock()
+	defer v.writeMu.Unlock()
+	if v.isWriteClosed() {
+		return 0, &OpError{Op: "write", Target: v.remoteCall, Err: net.ErrClosed}
+	}
+	v.session.log.Debug("Sending data", "bytes", len(b))
 	v.bufferCount.incr(len(b))
-	v.lastWrite = time.Now()
-	return v.dataConn.Write(b)
+	v.lastWrite = v.config.Clock.Now()
+	n, err := v.writeData(b)
+	v.session.progress.wrote(n, v.lastWrite)
+	v.session.quality.sent(v.lastWrite)
+	return n, err
+}
+
+func (v *conn) isWriteClosed() bool {
+	select {
+	case <-v.writeClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// expired returns the reason the session was terminated by a session limit, if any.
+func (v *conn) expired() error {
+	v.sessionMu.Lock()
+	defer v.sessionMu.Unlock()
+	return v.session.expired
 }
 
 // TxBufferLen implements the transport.TxBuffer interface.
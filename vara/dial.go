@@ -0,0 +1,176 @@
+package vara
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DialFunc connects to the address on the named network, in the fashion of net.Dialer.DialContext.
+//
+// It's used to reach the command and data ports of the VARA modem program, with network "tcp" and
+// address "host:port". Custom implementations may ignore these, e.g. to dial a Unix socket
+// forwarded to the VARA host or to open a channel through an SSH connection.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// dial connects to the given port of the VARA modem program.
+func (m *Modem) dial(ctx context.Context, port int) (net.Conn, error) {
+	addr := net.JoinHostPort(m.config.Host, strconv.Itoa(port))
+	if dial := m.config.DialContext; dial != nil {
+		return dial(ctx, "tcp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// SOCKS5Dialer returns a DialFunc connecting through the SOCKS5 proxy at proxyAddr (RFC 1928), such
+// as the one provided by `ssh -D`. The username and password are optional (RFC 1929).
+//
+// Host names are resolved by the proxy.
+func SOCKS5Dialer(proxyAddr, username, password string) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" {
+			return nil, fmt.Errorf("socks5: unsupported network %q", network)
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Make the handshake respect the context.
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+
+		if err := socks5Handshake(conn, address, username, password); err != nil {
+			conn.Close()
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, fmt.Errorf("socks5: %s via %s: %w", address, proxyAddr, err)
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+var socks5Errors = []string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func socks5Handshake(rw io.ReadWriter, address, username, password string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Method negotiation
+	methods := []byte{0x00} // No authentication
+	if username != "" {
+		methods = append(methods, 0x02) // Username/password
+	}
+	if _, err := rw.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	switch {
+	case resp[0] != 0x05:
+		return fmt.Errorf("unexpected protocol version %d", resp[0])
+	case resp[1] == 0x02 && username != "":
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("username or password too long")
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := rw.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	case resp[1] != 0x00:
+		return errors.New("no acceptable authentication method")
+	}
+
+	// Connect request
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := rw.Write(req); err != nil {
+		return err
+	}
+
+	// Reply: version, status, reserved, bound address type, address and port
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(rw, hdr); err != nil {
+		return err
+	}
+	if hdr[1] != 0x00 {
+		if int(hdr[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[hdr[1]])
+		}
+		return fmt.Errorf("connect failed with status %d", hdr[1])
+	}
+	var addrLen int
+	switch hdr[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		if _, err := io.ReadFull(rw, resp[:1]); err != nil {
+			return err
+		}
+		addrLen = int(resp[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", hdr[3])
+	}
+	// Skip the bound address and port
+	_, err = io.ReadFull(rw, make([]byte, addrLen+2))
+	return err
+}
@@ -0,0 +1,98 @@
+package vara
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// socks5Proxy is a minimal SOCKS5 proxy requiring username/password authentication.
+func socks5Proxy(t *testing.T, username, password string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 512)
+				read := func(n int) []byte {
+					if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+						runtime.Goexit()
+					}
+					return buf[:n]
+				}
+				read(int(read(2)[1])) // Methods
+				conn.Write([]byte{0x05, 0x02})
+				user := string(read(int(read(2)[1])))
+				pass := string(read(int(read(1)[0])))
+				if user != username || pass != password {
+					conn.Write([]byte{0x01, 0x01})
+					return
+				}
+				conn.Write([]byte{0x01, 0x00})
+				if hdr := read(4); hdr[3] != 0x03 {
+					t.Errorf("expected domain name address type, got %d", hdr[3])
+					return
+				}
+				host := string(read(int(read(1)[0])))
+				port := read(2)
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	proxy := socks5Proxy(t, "user", "secret")
+	defer proxy.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	if _, err := SOCKS5Dialer(proxy.Addr().String(), "user", "wrong")(context.Background(), "tcp", addr); err == nil {
+		t.Error("expected authentication failure")
+	}
+
+	conn, err := SOCKS5Dialer(proxy.Addr().String(), "user", "secret")(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	msg := []byte("MYCALL N0CALL\r")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Errorf("unexpected echo %q: %v", got, err)
+	}
+}
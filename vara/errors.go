@@ -0,0 +1,84 @@
+package vara
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Errors describing why an operation failed.
+//
+// They are typically wrapped in an *OpError carrying additional context, use errors.Is to test for them.
+var (
+	// ErrTNCUnavailable is returned when the connection to the VARA modem program is lost, and not
+	// (yet) restored.
+	ErrTNCUnavailable = errors.New("TNC unavailable")
+	// ErrConnectTimeout is returned when the link could not be established, most likely because
+	// the remote station did not answer.
+	ErrConnectTimeout = errors.New("connect timeout")
+	// ErrModemBusy is returned when dialing while the modem is already connecting or connected.
+	ErrModemBusy = errors.New("modem busy")
+	// ErrChannelBusy is returned when dialing was aborted while waiting for a busy channel to clear.
+	ErrChannelBusy = errors.New("channel busy")
+	// ErrBufferStalled is returned when the TX buffer did not drain within Timing.BufferTimeout.
+	ErrBufferStalled = errors.New("buffer stalled")
+	// ErrDisconnectTimeout is returned when the link was aborted after failing to disconnect
+	// gracefully within Timing.DisconnectTimeout.
+	ErrDisconnectTimeout = errors.New("disconnect timeout")
+	// ErrIdleTimeout is returned when a connection was closed after exceeding the maximum idle time.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrSessionTimeout is returned when a connection was closed after exceeding the maximum session
+	// duration.
+	ErrSessionTimeout = errors.New("session timeout")
+	// ErrBacklogFull is reported when an inbound connection is dropped because no one is calling
+	// Accept and the listener's backlog is full.
+	ErrBacklogFull = errors.New("backlog full")
+	// ErrAcceptTimeout is reported when an inbound connection is dropped after waiting too long in the
+	// listener's backlog.
+	ErrAcceptTimeout = errors.New("accept timeout")
+	// ErrRejected is returned when a request was rejected by the modem, or when an inbound connection
+	// was rejected by the listener's admission policy.
+	ErrRejected = errors.New("rejected")
+)
+
+// OpError is the error type returned by the modem and its connections.
+type OpError struct {
+	// Op is the operation which caused the error, such as "dial", "write" or "close".
+	Op string
+	// Target is the remote callsign, if any.
+	Target string
+	// Elapsed is the time spent on the operation before it failed, if known.
+	Elapsed time.Duration
+	// Err is the underlying error, typically one of the Err* variables of this package.
+	Err error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Target != "" {
+		s += " " + e.Target
+	}
+	s += ": " + e.Err.Error()
+	if e.Elapsed > 0 {
+		s += fmt.Sprintf(" (after %s)", e.Elapsed.Round(time.Millisecond))
+	}
+	return s
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the error was caused by a timeout.
+func (e *OpError) Timeout() bool {
+	return errors.Is(e.Err, ErrConnectTimeout) ||
+		errors.Is(e.Err, ErrBufferStalled) ||
+		errors.Is(e.Err, ErrDisconnectTimeout) ||
+		errors.Is(e.Err, ErrIdleTimeout) ||
+		errors.Is(e.Err, ErrSessionTimeout)
+}
+
+// Temporary reports whether the operation may succeed if retried later.
+func (e *OpError) Temporary() bool {
+	return errors.Is(e.Err, ErrConnectTimeout) ||
+		errors.Is(e.Err, ErrModemBusy) ||
+		errors.Is(e.Err, ErrChannelBusy)
+}
@@ -0,0 +1,168 @@
+package vara
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Health describes the health of the connection with the VARA modem program.
+type Health struct {
+	// Connected is true if the modem is connected to the VARA modem program
+	Connected bool
+	// Uptime is the time since the connection with the VARA modem program was established
+	Uptime time.Duration
+	// LastAlive is when the last IAMALIVE was received, if any
+	LastAlive time.Time
+	// LastCommand is when the last command of any kind was received, if any
+	LastCommand time.Time
+	// RTT is the round-trip time of the last successful probe, if any
+	RTT time.Duration
+	// LastProbe is when the last probe completed, successfully or not
+	LastProbe time.Time
+	// ProtocolErrors is the number of WRONG replies and unexpected commands received since connecting
+	ProtocolErrors int
+	// LastProtocolError describes the last protocol error, if any
+	LastProtocolError string
+	// Degraded is true if the VARA modem program seems to be wedged, even though the connection is
+	// not yet considered lost: it has been silent for longer than Timing.DegradedTimeout, or the last
+	// probe failed
+	Degraded bool
+	// Reason explains why the connection is degraded
+	Reason string
+}
+
+// health tracks the health of the connection with the VARA modem program.
+type health struct {
+	mu                sync.Mutex
+	connectedAt       time.Time // Zero while disconnected
+	lastAlive         time.Time
+	lastCmd           time.Time
+	rtt               time.Duration
+	lastProbe         time.Time
+	probeErr          error
+	protocolErrors    int
+	lastProtocolError string
+}
+
+func (h *health) connected(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connectedAt, h.lastCmd, h.lastAlive = now, now, time.Time{}
+	h.rtt, h.lastProbe, h.probeErr = 0, time.Time{}, nil
+	h.protocolErrors, h.lastProtocolError = 0, ""
+}
+
+func (h *health) disconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connectedAt = time.Time{}
+}
+
+func (h *health) received(cmd string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCmd = now
+	if cmd == "IAMALIVE" {
+		h.lastAlive = now
+	}
+}
+
+func (h *health) protocolError(desc string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.protocolErrors++
+	h.lastProtocolError = desc
+}
+
+func (h *health) probed(rtt time.Duration, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastProbe, h.probeErr = now, err
+	if err == nil {
+		h.rtt = rtt
+	}
+}
+
+func (h *health) snapshot(degradedTimeout time.Duration, now time.Time) Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := Health{
+		Connected:         !h.connectedAt.IsZero(),
+		LastAlive:         h.lastAlive,
+		LastCommand:       h.lastCmd,
+		RTT:               h.rtt,
+		LastProbe:         h.lastProbe,
+		ProtocolErrors:    h.protocolErrors,
+		LastProtocolError: h.lastProtocolError,
+	}
+	if !s.Connected {
+		return s
+	}
+	s.Uptime = now.Sub(h.connectedAt)
+	switch silent := now.Sub(h.lastCmd); {
+	case silent > degradedTimeout:
+		s.Degraded, s.Reason = true, fmt.Sprintf("no command received for %s", silent.Round(time.Second))
+	case h.probeErr != nil:
+		s.Degraded, s.Reason = true, fmt.Sprintf("probe failed: %v", h.probeErr)
+	}
+	return s
+}
+
+// Health returns the health of the connection with the VARA modem program.
+func (m *Modem) Health() Health {
+	return m.health.snapshot(m.config.Timing.DegradedTimeout, m.config.Clock.Now())
+}
+
+// Probe measures the round-trip time of a VERSION query to the VARA modem program, recording the
+// result in Health.
+//
+// VERSION is used since its reply can't be mistaken for the OK replying to any other command.
+func (m *Modem) Probe() (time.Duration, error) { return m.ProbeContext(context.Background()) }
+
+// ProbeContext is like Probe, but gives up when the context is cancelled. The cancellation is
+// recorded as a failed probe.
+func (m *Modem) ProbeContext(ctx context.Context) (time.Duration, error) {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	rtt, err := m.probe(ctx)
+	if err != ErrModemClosed {
+		m.health.probed(rtt, err, m.config.Clock.Now())
+	}
+	return rtt, err
+}
+
+func (m *Modem) probe(ctx context.Context) (time.Duration, error) {
+	start := m.config.Clock.Now()
+	if _, err := m.queryVersion(ctx, "probe"); err != nil {
+		return 0, err
+	}
+	return m.config.Clock.Now().Sub(start), nil
+}
+
+// probeLoop probes the VARA modem program every Timing.ProbeInterval, until the connection given
+// by ready is lost.
+func (m *Modem) probeLoop(ready chan struct{}) {
+	interval := m.config.Timing.ProbeInterval
+	for {
+		wait, stop := m.after(interval)
+		select {
+		case <-wait:
+		case <-m.done:
+			stop()
+			return
+		}
+		m.connMu.Lock()
+		current := m.tncReady
+		m.connMu.Unlock()
+		if current != ready {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if _, err := m.ProbeContext(ctx); err != nil {
+			m.logger.Debug("Probe failed", "error", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,161 @@
+package vara
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// INISettings holds the settings of a VARA modem program, as read from its .ini file (VARA.ini for
+// VARA HF, VARAFM.ini for VARA FM).
+type INISettings struct {
+	// Path is the file the settings were read from, if any
+	Path string
+	// CmdPort is the TCP command port ("TCP Command Port")
+	CmdPort int
+	// DataPort is the TCP data port, which VARA always opens next to the command port
+	DataPort int
+	// Callsigns are the callsigns VARA is registered to ("Callsign Licence N")
+	Callsigns []string
+}
+
+// iniFiles maps schemes to the install directory and .ini file of their VARA modem program.
+var iniFiles = map[string][2]string{
+	"varahf": {"VARA", "VARA.ini"},
+	"varafm": {"VARA FM", "VARAFM.ini"},
+}
+
+// LoadINI finds and reads the .ini file of the VARA modem program for the given scheme ("varahf" or
+// "varafm").
+//
+// On Windows, the file is looked for in the default install directory on the system drive. Elsewhere
+// it's looked for in the Wine prefix given by $WINEPREFIX, defaulting to ~/.wine.
+func LoadINI(scheme string) (*INISettings, error) {
+	paths, err := iniPaths(scheme)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		s, err := ReadINI(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return s, err
+	}
+	return nil, fmt.Errorf("no VARA .ini file found (looked for %s): %w", strings.Join(paths, ", "), os.ErrNotExist)
+}
+
+func iniPaths(scheme string) ([]string, error) {
+	f, ok := iniFiles[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	var root string
+	switch {
+	case runtime.GOOS == "windows":
+		root = os.Getenv("SystemDrive") + `\`
+		if root == `\` {
+			root = `C:\`
+		}
+	case os.Getenv("WINEPREFIX") != "":
+		root = filepath.Join(os.Getenv("WINEPREFIX"), "drive_c")
+	default:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		root = filepath.Join(home, ".wine", "drive_c")
+	}
+	return []string{
+		filepath.Join(root, f[0], f[1]),
+		filepath.Join(root, "Program Files", f[0], f[1]),
+		filepath.Join(root, "Program Files (x86)", f[0], f[1]),
+	}, nil
+}
+
+// ReadINI reads the VARA .ini file at path.
+func ReadINI(path string) (*INISettings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ParseINI(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s.Path = path
+	return s, nil
+}
+
+// ParseINI parses the contents of a VARA .ini file.
+func ParseINI(r io.Reader) (*INISettings, error) {
+	var s INISettings
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.EqualFold(key, "TCP Command Port"):
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %q", key, value)
+			}
+			s.CmdPort = port
+		case strings.HasPrefix(strings.ToLower(key), "callsign licence") && value != "":
+			s.Callsigns = append(s.Callsigns, strings.ToUpper(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if s.CmdPort != 0 {
+		s.DataPort = s.CmdPort + 1
+	}
+	return &s, nil
+}
+
+// Apply fills the ports of config not already set with the ones VARA is configured with. It
+// returns an error for each explicitly set port VARA is not configured to use, and if VARA is
+// registered to callsigns other than myCall (the callsign given to NewModem).
+func (s *INISettings) Apply(config *ModemConfig, myCall string) (mismatches []error) {
+	check := func(name string, port *int, want int) {
+		switch {
+		case want == 0:
+		case *port == 0:
+			*port = want
+		case *port != want:
+			mismatches = append(mismatches, fmt.Errorf("%s port is %d, but VARA is configured with %d", name, *port, want))
+		}
+	}
+	check("command", &config.CmdPort, s.CmdPort)
+	check("data", &config.DataPort, s.DataPort)
+	if len(s.Callsigns) > 0 && !s.Registered(myCall) {
+		mismatches = append(mismatches, fmt.Errorf("callsign is %s, but VARA is registered to %s", myCall, strings.Join(s.Callsigns, ", ")))
+	}
+	return mismatches
+}
+
+// Registered returns true if VARA is registered to the given callsign (ignoring any SSID).
+func (s *INISettings) Registered(call string) bool {
+	base := strings.ToUpper(strings.SplitN(call, "-", 2)[0])
+	for _, c := range s.Callsigns {
+		if c == base {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package vara
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+)
+
+// sessionLimits defines the maximum idle time and total duration of a session. Zero means no limit.
+type sessionLimits struct {
+	idle     time.Duration
+	duration time.Duration
+}
+
+func (m *Modem) defaultLimits() sessionLimits {
+	return sessionLimits{idle: m.config.IdleTimeout, duration: m.config.MaxSessionDuration}
+}
+
+// urlLimits returns the session limits for the given URL, overriding the modem defaults with the
+// idle_timeout and max_duration URL parameters (e.g. "idle_timeout=5m&max_duration=1h").
+func (m *Modem) urlLimits(url *transport.URL) (sessionLimits, error) {
+	l := m.defaultLimits()
+	for key, d := range map[string]*time.Duration{"idle_timeout": &l.idle, "max_duration": &l.duration} {
+		v := url.Params.Get(key)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *d, err = time.ParseDuration(v); err != nil {
+			return l, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return l, nil
+}
+
+// enforceLimits gracefully closes the connection if it exceeds the given limits.
+func (v *conn) enforceLimits(l sessionLimits) {
+	v.sessionMu.Lock()
+	defer v.sessionMu.Unlock()
+	if v.session.ended {
+		return
+	}
+	clock := v.config.Clock
+	start := clock.Now()
+	if l.duration > 0 {
+		v.session.timers = append(v.session.timers, clock.AfterFunc(l.duration, func() {
+			v.expire(&OpError{Op: "read", Target: v.remoteCall, Elapsed: clock.Now().Sub(start), Err: ErrSessionTimeout})
+		}))
+	}
+	if l.idle > 0 {
+		var idle Timer
+		idle = clock.AfterFunc(l.idle, func() {
+			// We hold sessionMu until idle is assigned.
+			v.sessionMu.Lock()
+			since := clock.Now().Sub(v.session.quality.lastActivity())
+			if v.session.ended {
+				v.sessionMu.Unlock()
+				return
+			}
+			if since < l.idle {
+				idle.Reset(l.idle - since)
+				v.sessionMu.Unlock()
+				return
+			}
+			v.sessionMu.Unlock()
+			v.expire(&OpError{Op: "read", Target: v.remoteCall, Elapsed: since, Err: ErrIdleTimeout})
+		})
+		v.session.timers = append(v.session.timers, idle)
+	}
+}
+
+// expire gracefully closes the connection because it exceeded one of its limits.
+//
+// Subsequent reads and writes return err.
+func (v *conn) expire(err *OpError) {
+	v.sessionMu.Lock()
+	if v.session.ended || v.session.expired != nil {
+		v.sessionMu.Unlock()
+		return
+	}
+	v.session.expired = err.Err
+	v.session.end = EndTimeout
+	v.sessionMu.Unlock()
+
+	v.session.log.Info("Session limit exceeded", "error", err)
+	v.session.rx.closeWithError(err)
+	go v.Close()
+}
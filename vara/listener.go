@@ -1,42 +1,215 @@
 package vara
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
+	"time"
 )
 
 var ErrListenerClosed = errors.New("listener closed")
 
 type listener struct {
 	*Modem
+	admission *admission // Optional
+	lc        ListenConfig
+
+	mu      sync.Mutex
+	pending []pendingConn // Inbound connections waiting for Accept
+	ready   chan struct{} // Signaled when a connection is queued
+	closed  bool
+	drops   sync.WaitGroup // Drops in progress, waited for by Close
 
 	closeOnce sync.Once
 	done      chan struct{}
 }
 
-// Accept waits for and returns the next connection to the listener.
-func (m *Modem) Listen() (net.Listener, error) {
-	if m.closed {
+type pendingConn struct {
+	*conn
+	timer Timer
+}
+
+// ListenConfig contains options for listening for inbound connections.
+type ListenConfig struct {
+	// Admission decides which remote stations are allowed to connect; optional.
+	Admission *AdmissionPolicy
+	// Backlog is the number of inbound connections held while no one is calling Accept; defaults
+	// to 1. If negative, an inbound connection is disconnected immediately unless Accept is being
+	// called.
+	Backlog int
+	// AcceptTimeout is how long an inbound connection is held in the backlog before it is
+	// disconnected; defaults to 30 seconds.
+	AcceptTimeout time.Duration
+	// DropFunc is called when an inbound connection is disconnected without being accepted; optional.
+	//
+	// It is called from its own goroutine, and never after the listener's Close has returned.
+	DropFunc func(call string, reason error)
+}
+
+// Listen enables inbound connections on the modem, returning a listener accepting them.
+func (m *Modem) Listen() (net.Listener, error) { return ListenConfig{}.Listen(m) }
+
+// Listen enables inbound connections on the modem, returning a listener accepting them according
+// to the config.
+//
+// If the VARA modem program is unavailable and ModemConfig.WaitForTNC is set, inbound connections
+// are enabled once it becomes available.
+func (lc ListenConfig) Listen(m *Modem) (net.Listener, error) {
+	if a := lc.Admission; a != nil && a.RateLimit > 0 && a.RatePeriod <= 0 {
+		return nil, errors.New("admission policy has a RateLimit, but no RatePeriod")
+	}
+	if m.isClosed() {
 		return nil, ErrModemClosed
 	}
+	if lc.Backlog == 0 {
+		lc.Backlog = 1
+	}
+	if lc.AcceptTimeout == 0 {
+		lc.AcceptTimeout = 30 * time.Second
+	}
+	ln := &listener{
+		Modem: m,
+		lc:    lc,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	if lc.Admission != nil {
+		ln.admission = newAdmission(*lc.Admission)
+	}
+	m.setStatus(func() { m.activeListener = ln })
 	if err := m.writeCmd("LISTEN ON"); err != nil {
+		if err == ErrTNCUnavailable && m.config.WaitForTNC {
+			m.logger.Debug("TNC unavailable, LISTEN ON is sent when it becomes available")
+			return ln, nil
+		}
+		m.setStatus(func() { m.activeListener = nil })
 		return nil, err
 	}
-	return &listener{Modem: m, done: make(chan struct{})}, nil
+	return ln, nil
 }
 
 // Accept waits for and returns the next inbound connection.
-func (ln *listener) Accept() (net.Conn, error) {
+func (ln *listener) Accept() (net.Conn, error) { return ln.AcceptContext(context.Background()) }
+
+// AcceptContext is like Accept, but returns ctx.Err() if the context is cancelled before a
+// connection is accepted.
+func (ln *listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	for {
+		if conn := ln.dequeue(); conn != nil {
+			conn.session.log.Debug("Accepted connection from backlog")
+			return conn, nil
+		}
+		select {
+		case conn, ok := <-ln.inboundConns:
+			if !ok {
+				return nil, ErrModemClosed
+			}
+			conn.session.log.Debug("Accepted connection")
+			return conn, nil
+		case <-ln.ready:
+		case <-ln.done:
+			return nil, ErrListenerClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// enqueue hands an inbound connection to Accept, holding it in the backlog if no one is
+// currently calling Accept. The connection is dropped if the backlog is full.
+func (ln *listener) enqueue(c *conn) {
 	select {
-	case conn, ok := <-ln.inboundConns:
-		debugPrint("Accept() got: %v %v", conn, ok)
-		if !ok {
-			return nil, ErrModemClosed
+	case ln.inboundConns <- c:
+		return
+	default:
+	}
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	switch {
+	case ln.closed:
+		c.session.log.Debug("Listener closed, dropping inbound connection")
+		go c.Close()
+		return
+	case len(ln.pending) >= ln.lc.Backlog:
+		c.session.log.Debug("No one is calling Accept() at this time, dropping inbound connection")
+		ln.dropAsync(c, ErrBacklogFull)
+		return
+	}
+	c.session.log.Debug("No one is calling Accept() at this time, holding inbound connection")
+	timer := ln.Modem.config.Clock.AfterFunc(ln.lc.AcceptTimeout, func() {
+		ln.mu.Lock()
+		defer ln.mu.Unlock()
+		if ln.remove(c) {
+			ln.dropAsync(c, ErrAcceptTimeout)
+		}
+	})
+	ln.pending = append(ln.pending, pendingConn{c, timer})
+	ln.signal()
+}
+
+// dequeue returns the next connection from the backlog, or nil if the backlog is empty.
+//
+// Connections disconnected while waiting in the backlog are skipped.
+func (ln *listener) dequeue() *conn {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	for len(ln.pending) > 0 {
+		p := ln.pending[0]
+		ln.pending = ln.pending[1:]
+		p.timer.Stop()
+		ln.sessionMu.Lock()
+		ended := p.session.ended
+		ln.sessionMu.Unlock()
+		if ended {
+			p.session.log.Debug("Accept() skipping connection disconnected while in backlog")
+			continue
+		}
+		if len(ln.pending) > 0 {
+			ln.signal() // Wake up any other Accept
+		}
+		return p.conn
+	}
+	return nil
+}
+
+// remove removes c from the backlog, returning false if it was not found. The caller must hold
+// ln.mu.
+func (ln *listener) remove(c *conn) bool {
+	for i, p := range ln.pending {
+		if p.conn == c {
+			ln.pending = append(ln.pending[:i], ln.pending[i+1:]...)
+			return true
 		}
-		return conn, nil
-	case <-ln.done:
-		return nil, ErrListenerClosed
+	}
+	return false
+}
+
+// signal wakes up a blocked Accept. The caller must hold ln.mu.
+func (ln *listener) signal() {
+	select {
+	case ln.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dropAsync drops c in a new goroutine, as disconnecting blocks until the command reader has
+// handled DISCONNECTED. The caller must hold ln.mu, and the listener must not be closed.
+func (ln *listener) dropAsync(c *conn, reason error) {
+	ln.drops.Add(1)
+	go func() {
+		defer ln.drops.Done()
+		ln.drop(c, reason)
+	}()
+}
+
+// drop disconnects an inbound connection that was never accepted.
+func (ln *listener) drop(c *conn, reason error) {
+	c.session.log.Warn("VARA dropped inbound connection", "reason", reason)
+	c.Close()
+	if fn := ln.lc.DropFunc; fn != nil {
+		fn(c.remoteCall, reason)
 	}
 }
 
@@ -44,13 +217,30 @@ func (ln *listener) Accept() (net.Conn, error) {
 func (ln *listener) Addr() net.Addr { return Addr{ln.myCall} }
 
 // Close closes the listener, any blocked Accept operations will be unblocked.
+//
+// Connections waiting in the backlog are disconnected before Close returns.
 func (ln *listener) Close() error {
 	var err error
 	ln.closeOnce.Do(func() {
-		err = ln.writeCmd("LISTEN OFF")
-		if err == nil {
-			close(ln.done)
+		ln.setStatus(func() {
+			if ln.activeListener == ln {
+				ln.activeListener = nil
+			}
+		})
+		close(ln.done)
+		if err = ln.writeCmd("LISTEN OFF"); err == ErrTNCUnavailable {
+			err = nil // LISTEN OFF is sent when the TNC is available again
+		}
+		// Disconnect any connections still waiting in the backlog
+		ln.mu.Lock()
+		pending := ln.pending
+		ln.pending, ln.closed = nil, true
+		ln.mu.Unlock()
+		for _, p := range pending {
+			p.timer.Stop()
+			ln.drop(p.conn, ErrListenerClosed)
 		}
+		ln.drops.Wait()
 	})
 	return err
 }
@@ -0,0 +1,82 @@
+package vara
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Logger is a leveled, structured logger. Messages are accompanied by alternating keys and values,
+// such as the remote callsign and session ID.
+//
+// It's satisfied by *slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// stdLogger is the default Logger. It writes to the standard logger, and debug messages to stderr
+// if the VARA_DEBUG environment variable is set.
+type stdLogger struct{}
+
+var debugLogger = func() *log.Logger {
+	if t, _ := strconv.ParseBool(os.Getenv("VARA_DEBUG")); !t {
+		return nil
+	}
+	return log.New(os.Stderr, "[VARA] ", log.LstdFlags|log.Lmicroseconds)
+}()
+
+func (stdLogger) Debug(msg string, args ...interface{}) {
+	if debugLogger != nil {
+		debugLogger.Print(formatLog(msg, args))
+	}
+}
+
+func (stdLogger) Info(msg string, args ...interface{})  { log.Print(formatLog(msg, args)) }
+func (stdLogger) Warn(msg string, args ...interface{})  { log.Print(formatLog(msg, args)) }
+func (stdLogger) Error(msg string, args ...interface{}) { log.Print(formatLog(msg, args)) }
+
+// formatLog formats the message followed by key=value pairs.
+func formatLog(msg string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+			break
+		}
+		v := fmt.Sprint(args[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], v)
+	}
+	return b.String()
+}
+
+// fieldLogger prepends fields to the arguments of every message.
+type fieldLogger struct {
+	Logger
+	fields []interface{}
+}
+
+// withFields returns a Logger adding the given key-value pairs to every message.
+func withFields(l Logger, fields ...interface{}) Logger {
+	if fl, ok := l.(fieldLogger); ok {
+		return fieldLogger{fl.Logger, append(fl.fields[:len(fl.fields):len(fl.fields)], fields...)}
+	}
+	return fieldLogger{l, fields}
+}
+
+func (l fieldLogger) args(args []interface{}) []interface{} {
+	return append(l.fields[:len(l.fields):len(l.fields)], args...)
+}
+
+func (l fieldLogger) Debug(msg string, args ...interface{}) { l.Logger.Debug(msg, l.args(args)...) }
+func (l fieldLogger) Info(msg string, args ...interface{})  { l.Logger.Info(msg, l.args(args)...) }
+func (l fieldLogger) Warn(msg string, args ...interface{})  { l.Logger.Warn(msg, l.args(args)...) }
+func (l fieldLogger) Error(msg string, args ...interface{}) { l.Logger.Error(msg, l.args(args)...) }
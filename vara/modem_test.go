@@ -0,0 +1,816 @@
+package vara_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+	"github.com/n8jja/Pat-Vara/vara"
+	"github.com/n8jja/Pat-Vara/vara/varatest"
+)
+
+// newTestModem returns a modem connected to a fake TNC. The config is applied on top of the
+// TNC's ports.
+func newTestModem(t *testing.T, opts varatest.TNCOptions, config vara.ModemConfig) (*varatest.TNC, *vara.Modem) {
+	t.Helper()
+	tnc, err := varatest.NewTNC(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tnc.Close() })
+	tc := tnc.ModemConfig()
+	config.Host, config.CmdPort, config.DataPort = tc.Host, tc.CmdPort, tc.DataPort
+	if config.Timing.LateDataWindow == 0 {
+		config.Timing.LateDataWindow = 10 * time.Millisecond
+	}
+	if config.Timing.WriteSettleTime == 0 {
+		config.Timing.WriteSettleTime = 10 * time.Millisecond
+	}
+	m, err := vara.NewModem("varahf", "N0CALL", config)
+	if err != nil {
+		t.Fatalf("NewModem: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	// Make sure the TNC has accepted the modem before it's scripted.
+	if _, err := m.Version(); err != nil {
+		t.Fatalf("Version: %v", err)
+	}
+	return tnc, m
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestEarlyData(t *testing.T) {
+	ctx := testContext(t)
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+	ln, err := vara.ListenConfig{Backlog: 1}.Listen(m)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data is read before CONNECTED is handled.
+	if err := tnc.WriteData([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := tnc.Inbound("LA5NTA"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	tnc.Disconnect()
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "hello" {
+		t.Errorf("unexpected data %q: %v", b, err)
+	}
+}
+
+func TestLateDataAfterSession(t *testing.T) {
+	ctx := testContext(t)
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+	url := &transport.URL{Scheme: "varahf", Target: "LA5NTA"}
+	conn, err := m.DialURLContext(ctx, url)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	tnc.Disconnect()
+	// EOF is returned when the late data window is over.
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Read: %v", err)
+	}
+	conn.Close()
+
+	// Data read now belongs to no session, and must never reach the next one.
+	if err := tnc.WriteData([]byte("OLD-SESSION")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	conn, err = m.DialURLContext(ctx, url)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	if err := tnc.Send([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	tnc.Disconnect()
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "new" {
+		t.Errorf("unexpected data %q: %v", b, err)
+	}
+}
+
+func TestClockTimeouts(t *testing.T) {
+	t.Run("alive", func(t *testing.T) {
+		ctx := testContext(t)
+		clock := varatest.NewClock(time.Now())
+		lost := make(chan error, 1)
+		newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{
+			Clock:       clock,
+			Reconnect:   true,
+			TNCLostFunc: func(err error) { lost <- err },
+			Timing:      vara.Timing{AliveTimeout: 42 * time.Second},
+		})
+		if err := clock.WaitTimer(ctx, 42*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(41 * time.Second)
+		if len(lost) > 0 {
+			t.Fatal("TNC lost before AliveTimeout")
+		}
+		clock.Advance(time.Second)
+		select {
+		case <-lost:
+		case <-ctx.Done():
+			t.Fatal("TNC not lost after AliveTimeout")
+		}
+	})
+
+	t.Run("buffer", func(t *testing.T) {
+		ctx := testContext(t)
+		clock := varatest.NewClock(time.Now())
+		// VARA never reports the data as sent.
+		tnc, m := newTestModem(t, varatest.TNCOptions{TxDelay: time.Hour}, vara.ModemConfig{
+			Clock:  clock,
+			Timing: vara.Timing{BufferTimeout: 42 * time.Second},
+		})
+		conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer tnc.Disconnect()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		flushed := make(chan error, 1)
+		go func() { flushed <- conn.(transport.Flusher).Flush() }()
+		if err := clock.WaitTimer(ctx, 42*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		// Any BUFFER report restarts the timeout.
+		clock.Advance(30 * time.Second)
+		if err := tnc.SendCmd("BUFFER 5"); err != nil {
+			t.Fatal(err)
+		}
+		if err := clock.WaitTimer(ctx, 42*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(42 * time.Second)
+		var opErr *vara.OpError
+		if err := <-flushed; !errors.As(err, &opErr) || opErr.Err != vara.ErrBufferStalled || opErr.Elapsed != 72*time.Second {
+			t.Errorf("expected stalled buffer after 72s, got %v", err)
+		}
+	})
+}
+
+// logWaiter is a vara.Logger recording the messages logged, so tests can wait for the modem to
+// reach a given state.
+type logWaiter struct {
+	mu      sync.Mutex
+	msgs    []string
+	changed chan struct{} // Closed (and replaced) when a message is logged
+}
+
+func newLogWaiter() *logWaiter { return &logWaiter{changed: make(chan struct{})} }
+
+func (l *logWaiter) Debug(msg string, args ...interface{}) { l.log(msg) }
+func (l *logWaiter) Info(msg string, args ...interface{})  { l.log(msg) }
+func (l *logWaiter) Warn(msg string, args ...interface{})  { l.log(msg) }
+func (l *logWaiter) Error(msg string, args ...interface{}) { l.log(msg) }
+
+func (l *logWaiter) log(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// wait blocks until msg has been logged.
+func (l *logWaiter) wait(ctx context.Context, msg string) error {
+	for {
+		l.mu.Lock()
+		for _, v := range l.msgs {
+			if v == msg {
+				l.mu.Unlock()
+				return nil
+			}
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %q: %w", msg, ctx.Err())
+		}
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	t.Run("flush", func(t *testing.T) {
+		ctx := testContext(t)
+		tnc, m := newTestModem(t, varatest.TNCOptions{TxDelay: 10 * time.Millisecond}, vara.ModemConfig{})
+		conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+			t.Fatalf("CloseWrite: %v", err)
+		}
+		if got := string(tnc.Received()); got != "hello" {
+			t.Errorf("CloseWrite returned before flushing, transmitted %q", got)
+		}
+		if _, err := conn.Write([]byte("world")); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected net.ErrClosed writing after CloseWrite, got %v", err)
+		}
+	})
+
+	t.Run("blocked write", func(t *testing.T) {
+		ctx := testContext(t)
+		logger := newLogWaiter()
+		// VARA doesn't report the data as sent until told to.
+		tnc, m := newTestModem(t, varatest.TNCOptions{TxDelay: time.Hour}, vara.ModemConfig{Logger: logger})
+		conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer tnc.Disconnect()
+		if _, err := conn.Write([]byte("hello world")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write([]byte("!"))
+			written <- err
+		}()
+		if err := logger.wait(ctx, "Write waiting for buffer space"); err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan error, 1)
+		go func() { closed <- conn.(interface{ CloseWrite() error }).CloseWrite() }()
+		// The blocked write fails right away, while CloseWrite waits for the buffer to be flushed.
+		select {
+		case err := <-written:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("expected blocked write to fail with net.ErrClosed, got %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("write still blocked after CloseWrite")
+		}
+		if err := tnc.SendCmd("BUFFER 0"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-closed; err != nil {
+			t.Errorf("CloseWrite: %v", err)
+		}
+	})
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	ctx := testContext(t)
+	// A 500 Hz link is paced in chunks of 512 bytes.
+	tnc, m := newTestModem(t, varatest.TNCOptions{Bandwidth: "500", TxDelay: 10 * time.Millisecond}, vara.ModemConfig{})
+	conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 200)
+	r := &pacingReader{Reader: bytes.NewReader(data), tnc: tnc}
+	n, err := conn.(io.ReaderFrom).ReadFrom(r)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("ReadFrom: %d, %v", n, err)
+	}
+	if got, err := tnc.WaitReceived(ctx, len(data)); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("unexpected data transmitted (%d bytes): %v", len(got), err)
+	}
+	// The next chunk is not written until less than a chunk is buffered, so the chunk before the
+	// previous one must have been transmitted by the time the next one is read.
+	for i, transmitted := range r.transmitted {
+		if want := (i - 1) * 512; transmitted < want {
+			t.Errorf("chunk %d read with only %d bytes transmitted, want %d", i, transmitted, want)
+		}
+	}
+
+	if err := tnc.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	tnc.Disconnect()
+	var buf bytes.Buffer
+	n, err = conn.(io.WriterTo).WriteTo(&buf)
+	if err != nil || n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("WriteTo: %d, %v", n, err)
+	}
+}
+
+// pacingReader records the number of bytes transmitted by the TNC at each Read.
+type pacingReader struct {
+	io.Reader
+	tnc         *varatest.TNC
+	transmitted []int
+}
+
+func (r *pacingReader) Read(p []byte) (int, error) {
+	r.transmitted = append(r.transmitted, len(r.tnc.Received()))
+	return r.Reader.Read(p)
+}
+
+func TestSessionStats(t *testing.T) {
+	t.Run("remote", func(t *testing.T) {
+		ctx := testContext(t)
+		clock := varatest.NewClock(time.Now())
+		stats := make(chan vara.SessionStats, 1)
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{
+			Clock:            clock,
+			SessionStatsFunc: func(s vara.SessionStats) { stats <- s },
+		})
+		conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		clock.Advance(90 * time.Second)
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if _, err := tnc.WaitReceived(ctx, 5); err != nil {
+			t.Fatal(err)
+		}
+		if err := tnc.Send([]byte("world!")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 6)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		tnc.Disconnect()
+
+		var s vara.SessionStats
+		select {
+		case s = <-stats:
+		case <-ctx.Done():
+			t.Fatal("SessionStatsFunc not called")
+		}
+		switch {
+		case s.RemoteCall != "LA5NTA" || s.Inbound || s.Bandwidth != "2300":
+			t.Errorf("unexpected link: %+v", s)
+		case s.BytesSent != 5 || s.BytesReceived != 6:
+			t.Errorf("expected 5 bytes sent and 6 received, got %d and %d", s.BytesSent, s.BytesReceived)
+		case s.Duration != 90*time.Second:
+			t.Errorf("expected duration 90s, got %s", s.Duration)
+		case !s.Ended || s.End != vara.EndRemote:
+			t.Errorf("expected session ended by remote, got %v (ended: %t)", s.End, s.Ended)
+		}
+	})
+
+	t.Run("graceful", func(t *testing.T) {
+		ctx := testContext(t)
+		stats := make(chan vara.SessionStats, 1)
+		tnc, m := newTestModem(t, varatest.TNCOptions{Bandwidth: "500"}, vara.ModemConfig{
+			SessionStatsFunc: func(s vara.SessionStats) { stats <- s },
+		})
+		ln, err := vara.ListenConfig{Backlog: 1}.Listen(m)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer ln.Close()
+		if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		select {
+		case s := <-stats:
+			if !s.Inbound || s.Bandwidth != "500" || !s.Ended || s.End != vara.EndGraceful {
+				t.Errorf("expected inbound session ended gracefully, got %+v", s)
+			}
+		case <-ctx.Done():
+			t.Fatal("SessionStatsFunc not called")
+		}
+	})
+}
+
+func TestSessionLimits(t *testing.T) {
+	dial := func(t *testing.T, ctx context.Context, rawurl string) (*varatest.Clock, *varatest.TNC, net.Conn) {
+		clock := varatest.NewClock(time.Now())
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{
+			Clock:              clock,
+			MaxSessionDuration: 2 * time.Hour,
+			Timing:             vara.Timing{AliveTimeout: 24 * time.Hour}, // Don't lose the TNC while time flies
+		})
+		url, err := transport.ParseURL(rawurl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := m.DialURLContext(ctx, url)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return clock, tnc, conn
+	}
+	expectLimit := func(t *testing.T, conn net.Conn, want error, elapsed time.Duration) {
+		t.Helper()
+		_, err := conn.Read(make([]byte, 1))
+		var opErr *vara.OpError
+		if !errors.As(err, &opErr) || opErr.Err != want || opErr.Elapsed != elapsed {
+			t.Errorf("expected %v after %s, got %v", want, elapsed, err)
+		}
+	}
+
+	t.Run("idle_timeout", func(t *testing.T) {
+		ctx := testContext(t)
+		clock, tnc, conn := dial(t, ctx, "varahf:///LA5NTA?idle_timeout=1m")
+		if err := clock.WaitTimer(ctx, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		// Activity postpones the timeout.
+		clock.Advance(30 * time.Second)
+		if err := tnc.Send([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		clock.Advance(30 * time.Second)
+		if err := clock.WaitTimer(ctx, 30*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(30 * time.Second)
+		expectLimit(t, conn, vara.ErrIdleTimeout, time.Minute)
+		if _, err := tnc.WaitCmd(ctx, "DISCONNECT"); err != nil {
+			t.Error("link not disconnected after idle timeout")
+		}
+	})
+
+	t.Run("max_duration", func(t *testing.T) {
+		ctx := testContext(t)
+		clock, tnc, conn := dial(t, ctx, "varahf:///LA5NTA?max_duration=1h")
+		if err := clock.WaitTimer(ctx, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+		expectLimit(t, conn, vara.ErrSessionTimeout, time.Hour)
+		if _, err := tnc.WaitCmd(ctx, "DISCONNECT"); err != nil {
+			t.Error("link not disconnected after max duration")
+		}
+	})
+}
+
+func TestListenConfig(t *testing.T) {
+	type drop struct {
+		call   string
+		reason error
+	}
+	listen := func(t *testing.T, ctx context.Context, tnc *varatest.TNC, m *vara.Modem, lc vara.ListenConfig) (net.Listener, chan drop) {
+		drops := make(chan drop, 1)
+		lc.DropFunc = func(call string, reason error) { drops <- drop{call, reason} }
+		ln, err := lc.Listen(m)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+			t.Fatal(err)
+		}
+		return ln, drops
+	}
+	expectDrop := func(t *testing.T, ctx context.Context, tnc *varatest.TNC, drops chan drop, want error) {
+		t.Helper()
+		select {
+		case d := <-drops:
+			if d.call != "LA5NTA" || d.reason != want {
+				t.Errorf("expected %s dropped with %v, got %s dropped with %v", "LA5NTA", want, d.call, d.reason)
+			}
+		case <-ctx.Done():
+			t.Fatalf("DropFunc not called, expected %v", want)
+		}
+		if _, err := tnc.WaitCmd(ctx, "DISCONNECT"); err != nil {
+			t.Error("dropped connection not disconnected")
+		}
+	}
+
+	t.Run("backlog", func(t *testing.T) {
+		ctx := testContext(t)
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+		ln, drops := listen(t, ctx, tnc, m, vara.ListenConfig{})
+		// The inbound connection is held until Accept is called.
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer conn.Close()
+		if len(drops) > 0 {
+			t.Errorf("unexpected drop: %+v", <-drops)
+		}
+	})
+
+	t.Run("no backlog", func(t *testing.T) {
+		ctx := testContext(t)
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+		_, drops := listen(t, ctx, tnc, m, vara.ListenConfig{Backlog: -1})
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		expectDrop(t, ctx, tnc, drops, vara.ErrBacklogFull)
+	})
+
+	t.Run("accept timeout", func(t *testing.T) {
+		ctx := testContext(t)
+		clock := varatest.NewClock(time.Now())
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{Clock: clock})
+		_, drops := listen(t, ctx, tnc, m, vara.ListenConfig{AcceptTimeout: 10 * time.Second})
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		if err := clock.WaitTimer(ctx, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(9 * time.Second)
+		if len(drops) > 0 {
+			t.Fatal("dropped before AcceptTimeout")
+		}
+		clock.Advance(time.Second)
+		expectDrop(t, ctx, tnc, drops, vara.ErrAcceptTimeout)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		ctx := testContext(t)
+		logger := newLogWaiter()
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{Logger: logger})
+		ln, drops := listen(t, ctx, tnc, m, vara.ListenConfig{})
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		if err := logger.wait(ctx, "No one is calling Accept() at this time, holding inbound connection"); err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+		// The backlog is dropped before Close returns.
+		if len(drops) == 0 {
+			t.Fatal("DropFunc not called before Close returned")
+		}
+		expectDrop(t, ctx, tnc, drops, vara.ErrListenerClosed)
+	})
+
+	t.Run("admission", func(t *testing.T) {
+		ctx := testContext(t)
+		tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+		rejected := make(chan error, 1)
+		ln, _ := listen(t, ctx, tnc, m, vara.ListenConfig{Admission: &vara.AdmissionPolicy{
+			Deny:       []string{"LA5NTA-*"},
+			RejectFunc: func(call string, reason error) { rejected <- reason },
+		}})
+		if err := tnc.Inbound("LA5NTA-1"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-rejected:
+			if !errors.Is(err, vara.ErrRejected) {
+				t.Errorf("expected ErrRejected, got %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("RejectFunc not called")
+		}
+		if _, err := tnc.WaitCmd(ctx, "DISCONNECT"); err != nil {
+			t.Fatal("rejected connection not disconnected")
+		}
+
+		if err := tnc.Inbound("N0CALL-1"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.(interface {
+			AcceptContext(context.Context) (net.Conn, error)
+		}).AcceptContext(ctx)
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		defer conn.Close()
+		if got := conn.RemoteAddr().String(); got != "N0CALL-1" {
+			t.Errorf("accepted %s, expected N0CALL-1", got)
+		}
+	})
+}
+
+func TestSupervisor(t *testing.T) {
+	ctx := testContext(t)
+	lost, restored := make(chan error, 1), make(chan struct{}, 1)
+	resume := make(chan struct{}, 1)
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{
+		Reconnect: true,
+		TNCLostFunc: func(err error) {
+			lost <- err
+			// Hold the reconnect, so the test can act while the TNC is unavailable.
+			select {
+			case <-resume:
+			case <-ctx.Done():
+			}
+		},
+		TNCRestoredFunc: func() { restored <- struct{}{} },
+		Timing:          vara.Timing{ReconnectBackoff: 10 * time.Millisecond},
+	})
+	drop := func(t *testing.T, whileLost func()) {
+		t.Helper()
+		tnc.Drop()
+		select {
+		case <-lost:
+		case <-ctx.Done():
+			t.Fatal("TNCLostFunc not called")
+		}
+		whileLost()
+		resume <- struct{}{}
+		select {
+		case <-restored:
+		case <-ctx.Done():
+			t.Fatal("TNCRestoredFunc not called")
+		}
+	}
+	accept := func(t *testing.T, ln net.Listener) {
+		t.Helper()
+		if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.(interface {
+			AcceptContext(context.Context) (net.Conn, error)
+		}).AcceptContext(ctx)
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		conn.Close()
+	}
+
+	ln, err := m.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener is enabled again after reconnecting.
+	drop(t, func() {})
+	accept(t, ln)
+
+	// Closing the listener while the TNC is unavailable unblocks Accept.
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+	drop(t, func() {
+		if err := ln.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		select {
+		case err := <-accepted:
+			if err != vara.ErrListenerClosed {
+				t.Errorf("expected ErrListenerClosed, got %v", err)
+			}
+		case <-ctx.Done():
+			t.Error("Accept not unblocked by Close")
+		}
+	})
+	if _, err := tnc.WaitCmd(ctx, "LISTEN OFF"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listen works again after reconnecting.
+	ln, err = m.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	accept(t, ln)
+}
+
+func TestProbe(t *testing.T) {
+	ctx := testContext(t)
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+	if _, err := m.ProbeContext(ctx); err != nil {
+		t.Fatalf("Probe: %v", err)
+	}
+	if cmds := tnc.Commands(); cmds[len(cmds)-1] != "VERSION" {
+		t.Errorf("expected the probe to query VERSION, got %q", cmds[len(cmds)-1])
+	}
+	if h := m.Health(); h.LastProbe.IsZero() || h.Degraded {
+		t.Errorf("expected successful probe: %+v", h)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ctx := testContext(t)
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{})
+	// Poll concurrently with the state changes below, for the race detector.
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				m.Status()
+			}
+		}
+	}()
+	defer func() { close(stop); <-stopped }()
+
+	waitStatus := func(desc string, fn func(vara.Status) bool) {
+		t.Helper()
+		for !fn(m.Status()) {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("status not %s: %+v", desc, m.Status())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	if err := m.SetBandwidth("500"); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := m.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tnc.SetBusy(true); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("busy and listening at 500", func(s vara.Status) bool {
+		return s.Busy && s.Listening && s.Bandwidth == "500" && s.State == vara.StateDisconnected
+	})
+	if err := tnc.SetBusy(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tnc.Inbound("LA5NTA"); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus("connected", func(s vara.Status) bool {
+		return !s.Busy && s.State == vara.StateConnected && s.RemoteCall == "LA5NTA" && s.Inbound
+	})
+	tnc.Disconnect()
+	waitStatus("disconnected", func(s vara.Status) bool { return s.State == vara.StateDisconnected })
+}
+
+func TestServerLogger(t *testing.T) {
+	ctx := testContext(t)
+	logger := newLogWaiter()
+	tnc, m := newTestModem(t, varatest.TNCOptions{}, vara.ModemConfig{Logger: logger})
+	srv := &vara.Server{Handler: vara.HandlerFunc(func(net.Conn) { panic("oops") })}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe(m) }()
+	defer func() {
+		srv.Close()
+		<-served
+	}()
+	if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tnc.Inbound("LA5NTA"); err != nil {
+		t.Fatal(err)
+	}
+	// Panics are logged to the modem's Logger.
+	if err := logger.wait(ctx, "Panic serving connection"); err != nil {
+		t.Fatal(err)
+	}
+}
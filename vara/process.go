@@ -0,0 +1,166 @@
+package vara
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// portPollInterval is how often the TCP ports of a launched VARA modem program are probed.
+const portPollInterval = 250 * time.Millisecond
+
+// ProcessConfig configures a VARA modem program launched and supervised by the Modem.
+//
+// The program is launched when the modem is started, and restarted whenever the connection with it
+// is lost: when it crashes, stops sending IAMALIVE or reports MISSING SOUNDCARD. It is stopped when
+// the modem is closed.
+type ProcessConfig struct {
+	// Command is the program to run, e.g. "wine" (required)
+	Command string
+	// Args are the command line arguments, e.g. the path to VARA.exe
+	Args []string
+	// Dir is the working directory of the program; defaults to the current directory
+	Dir string
+	// Env holds additional environment variables of the form "key=value", e.g. "WINEPREFIX=..."
+	Env []string
+	// Stdout and Stderr receive the output of the program; discarded if nil
+	Stdout, Stderr io.Writer
+	// StartTimeout is how long to wait for the TCP ports to come up after launching the program;
+	// defaults to 1 minute
+	StartTimeout time.Duration
+}
+
+// process is a supervised VARA modem program.
+type process struct {
+	config ProcessConfig
+	log    Logger
+	onExit func(err error) // Called when the program exits without being stopped
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{} // Closed when cmd exits
+	stopping bool
+}
+
+func newProcess(config ProcessConfig, log Logger, onExit func(err error)) *process {
+	if config.StartTimeout == 0 {
+		config.StartTimeout = time.Minute
+	}
+	exited := make(chan struct{})
+	close(exited)
+	return &process{config: config, log: log, onExit: onExit, exited: exited}
+}
+
+// launch starts the program, unless it's already running.
+func (p *process) launch() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.exited:
+	default:
+		return nil // Still running
+	}
+	if p.config.Command == "" {
+		return errors.New("no VARA modem program configured")
+	}
+
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	cmd.Dir = p.config.Dir
+	cmd.Env = append(os.Environ(), p.config.Env...)
+	cmd.Stdout, cmd.Stderr = p.config.Stdout, p.config.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start VARA modem program: %w", err)
+	}
+	p.log.Debug("Started VARA modem program", "pid", cmd.Process.Pid)
+	exited := make(chan struct{})
+	p.cmd, p.exited, p.stopping = cmd, exited, false
+
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		p.mu.Lock()
+		stopping := p.stopping
+		p.mu.Unlock()
+		if stopping {
+			p.log.Debug("VARA modem program stopped")
+			return
+		}
+		p.log.Error("VARA modem program exited unexpectedly", "error", err)
+		if p.onExit != nil {
+			p.onExit(err)
+		}
+	}()
+	return nil
+}
+
+// stop kills the program, blocking until it has exited.
+func (p *process) stop() {
+	p.mu.Lock()
+	cmd, exited := p.cmd, p.exited
+	select {
+	case <-exited:
+		p.mu.Unlock()
+		return
+	default:
+	}
+	p.stopping = true
+	p.mu.Unlock()
+
+	p.log.Debug("Stopping VARA modem program", "pid", cmd.Process.Pid)
+	cmd.Process.Kill()
+	<-exited
+}
+
+// waitPorts blocks until the TCP ports of the launched program accept connections.
+func (m *Modem) waitPorts() error {
+	m.proc.mu.Lock()
+	exited := m.proc.exited
+	m.proc.mu.Unlock()
+	timeout, stop := m.after(m.proc.config.StartTimeout)
+	defer stop()
+	for _, port := range []int{m.config.CmdPort, m.config.DataPort} {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), portPollInterval)
+			conn, err := m.dial(ctx, port)
+			cancel()
+			if err == nil {
+				conn.Close()
+				break
+			}
+			poll, stopPoll := m.after(portPollInterval)
+			select {
+			case <-poll:
+				continue
+			case <-exited:
+				stopPoll()
+				return errors.New("VARA modem program exited during startup")
+			case <-timeout:
+				stopPoll()
+				return fmt.Errorf("VARA modem program did not open port %d within %s", port, m.proc.config.StartTimeout)
+			case <-m.done:
+				stopPoll()
+				return ErrModemClosed
+			}
+		}
+	}
+	return nil
+}
+
+// restartTNC forces a restart of the supervised VARA modem program by dropping the command
+// connection, making cmdListen fail.
+func (m *Modem) restartTNC(reason string) {
+	if m.proc == nil {
+		return
+	}
+	m.logger.Warn("Restarting VARA modem program", "reason", reason)
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if m.cmdConn != nil {
+		m.cmdConn.Close()
+	}
+}
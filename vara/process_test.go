@@ -0,0 +1,108 @@
+package vara
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestHelperProcess is a fake VARA modem program, opening the command and data ports given as
+// arguments. It's launched by TestProcess.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("VARA_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	cmdLn, err := net.Listen("tcp", "127.0.0.1:"+args[1])
+	if err != nil {
+		os.Exit(2)
+	}
+	dataLn, err := net.Listen("tcp", "127.0.0.1:"+args[2])
+	if err != nil {
+		os.Exit(2)
+	}
+	go func() {
+		for {
+			conn, err := dataLn.Accept()
+			if err != nil {
+				os.Exit(2)
+			}
+			go bufio.NewReader(conn).WriteTo(discard{})
+		}
+	}()
+	for {
+		conn, err := cmdLn.Accept()
+		if err != nil {
+			os.Exit(2)
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				if _, err := r.ReadString('\r'); err != nil {
+					return
+				}
+				conn.Write([]byte("OK\r"))
+			}
+		}()
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestProcess(t *testing.T) {
+	cmdPort, dataPort := freePort(t), freePort(t)
+	restored := make(chan struct{}, 1)
+	m, err := NewModem("varafm", "N0CALL", ModemConfig{
+		Host:     "127.0.0.1",
+		CmdPort:  cmdPort,
+		DataPort: dataPort,
+		Timing:   Timing{ReconnectBackoff: 10 * time.Millisecond},
+		Process: &ProcessConfig{
+			Command: os.Args[0],
+			Args:    []string{"-test.run=TestHelperProcess", "--", strconv.Itoa(cmdPort), strconv.Itoa(dataPort)},
+			Env:     []string{"VARA_HELPER_PROCESS=1"},
+		},
+		TNCRestoredFunc: func() { restored <- struct{}{} },
+	})
+	if err != nil {
+		t.Fatalf("NewModem: %v", err)
+	}
+	if !m.Ping() {
+		t.Fatal("expected modem to be connected to the launched program")
+	}
+
+	// Crash the program, and expect it to be restarted.
+	m.proc.mu.Lock()
+	m.proc.cmd.Process.Kill()
+	m.proc.mu.Unlock()
+	select {
+	case <-restored:
+	case <-time.After(10 * time.Second):
+		t.Fatal("program was not restarted")
+	}
+
+	m.Close()
+	select {
+	case <-m.proc.exited:
+	default:
+		t.Error("program still running after Close")
+	}
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,93 @@
+package vara
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress describes the progress of data sent over the air during a session.
+type Progress struct {
+	// Written is the number of bytes written to the modem.
+	Written int64
+	// Acked is the number of bytes acknowledged by the remote station over the air.
+	Acked int64
+	// Buffered is the number of bytes in the modem's TX buffer, not yet acknowledged.
+	Buffered int
+	// TimeToDrain is the estimated time until the TX buffer is empty, or zero if unknown.
+	TimeToDrain time.Duration
+}
+
+// AckFunc is a function that is called each time data is acknowledged over the air.
+//
+// It is called from the modem's command reader, and must return quickly.
+type AckFunc func(Progress)
+
+// progress tracks the TX progress of a session, based on the BUFFER reports from VARA.
+type progress struct {
+	mu         sync.Mutex
+	written    int64
+	acked      int64
+	reported   int       // Last reported BUFFER value
+	firstWrite time.Time // Start of the acked rate measurement
+	lastAck    time.Time
+	ackFunc    AckFunc
+}
+
+func (p *progress) wrote(n int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.written == 0 {
+		p.firstWrite = now
+	}
+	p.written += int64(n)
+}
+
+// buffer handles a BUFFER report, returning the number of bytes acked.
+//
+// VARA reports the buffer count both when data is added to the TX buffer and when acked data is
+// removed from it, so only decreasing counts are acknowledgements.
+func (p *progress) buffer(n int, now time.Time) (acked int) {
+	p.mu.Lock()
+	prev := p.reported
+	p.reported = n
+	if n >= prev {
+		p.mu.Unlock()
+		return 0
+	}
+	p.acked += int64(prev - n)
+	p.lastAck = now
+	snapshot, fn := p.snapshot(n), p.ackFunc
+	p.mu.Unlock()
+
+	if fn != nil {
+		fn(snapshot)
+	}
+	return prev - n
+}
+
+// snapshot returns the current progress. The caller must hold p.mu.
+func (p *progress) snapshot(buffered int) Progress {
+	pr := Progress{Written: p.written, Acked: p.acked, Buffered: buffered}
+	if elapsed := p.lastAck.Sub(p.firstWrite); p.acked > 0 && elapsed > 0 {
+		rate := float64(p.acked) / elapsed.Seconds() // bytes per second
+		pr.TimeToDrain = time.Duration(float64(buffered) / rate * float64(time.Second))
+	}
+	return pr
+}
+
+func (p *progress) setAckFunc(fn AckFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ackFunc = fn
+}
+
+// Progress returns the over the air progress of data written to the connection.
+func (v *conn) Progress() Progress {
+	v.session.progress.mu.Lock()
+	defer v.session.progress.mu.Unlock()
+	return v.session.progress.snapshot(v.TxBufferLen())
+}
+
+// SetAckFunc sets the function that will be called each time data written to the connection is
+// acknowledged over the air.
+func (v *conn) SetAckFunc(fn AckFunc) { v.session.progress.setAckFunc(fn) }
@@ -8,6 +8,7 @@ import (
 type pubSub struct {
 	in        chan string
 	req       chan subscriber
+	done      chan struct{} // Closed by Close
 	closeOnce *sync.Once
 }
 
@@ -29,12 +30,13 @@ func (s subscriber) wants(v string) bool {
 	return false
 }
 
-func (pb pubSub) Close() { pb.closeOnce.Do(func() { close(pb.in) }) }
+func (pb pubSub) Close() { pb.closeOnce.Do(func() { close(pb.done) }) }
 
 func newPubSub() pubSub {
 	pb := pubSub{
 		in:        make(chan string),
 		req:       make(chan subscriber),
+		done:      make(chan struct{}),
 		closeOnce: new(sync.Once),
 	}
 	go func() {
@@ -47,10 +49,9 @@ func newPubSub() pubSub {
 		}()
 		for {
 			select {
-			case v, ok := <-pb.in:
-				if !ok {
-					return
-				}
+			case <-pb.done:
+				return
+			case v := <-pb.in:
 				for i := 0; i < len(subscribers); i++ {
 					s := subscribers[i]
 					if !s.wants(v) {
@@ -63,10 +64,7 @@ func newPubSub() pubSub {
 					case s.c <- v:
 					}
 				}
-			case req, ok := <-pb.req:
-				if !ok {
-					return
-				}
+			case req := <-pb.req:
 				subscribers = append(subscribers, req)
 			}
 		}
@@ -74,14 +72,22 @@ func newPubSub() pubSub {
 	return pb
 }
 
+// Publish sends v to all subscribers wanting it. It's a no-op after Close.
 func (in pubSub) Publish(v string) {
-	in.in <- v
+	select {
+	case in.in <- v:
+	case <-in.done:
+	}
 }
 
 func (in pubSub) Subscribe(prefix ...string) (<-chan string, func()) {
 	c := make(chan string, 1)
 	q := make(chan struct{}, 1)
-	in.req <- subscriber{c, q, prefix}
+	select {
+	case in.req <- subscriber{c, q, prefix}:
+	case <-in.done:
+		close(c)
+	}
 	return c, func() {
 		select {
 		case q <- struct{}{}:
@@ -0,0 +1,221 @@
+package vara
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkQuality is a snapshot of the performance of a live link.
+//
+// Rates and duty cycles are calculated over the last Timing.LinkQualityWindow of the session, while stall
+// counters cover the whole session.
+type LinkQuality struct {
+	// Window is the period covered by the rates and duty cycles. It is shorter than the configured
+	// window early in a session.
+	Window time.Duration
+	// TxRate is the effective TX rate (acknowledged by the remote station) in bytes per second.
+	TxRate float64
+	// RxRate is the effective RX rate (received on the data port) in bytes per second.
+	RxRate float64
+	// TxDuty is the fraction of time spent transmitting (PTT on).
+	TxDuty float64
+	// RxDuty is the fraction of time not spent transmitting.
+	RxDuty float64
+	// SN is the S/N of the last received frame, only valid if HasSN is true.
+	// VARA only reports S/N in chat mode (CHAT ON).
+	SN    float64
+	HasSN bool
+	// Stalls is the number of periods with data in the TX buffer not being acknowledged for at least
+	// Timing.StallThreshold.
+	Stalls int
+	// StallTime is the total duration of those periods.
+	StallTime time.Duration
+	// Stalled is true if the TX buffer is currently stalled.
+	Stalled bool
+}
+
+type sample struct {
+	t time.Time
+	n int
+}
+
+type interval struct{ start, end time.Time } // Zero end means ongoing
+
+// linkQuality gathers the samples used to estimate the quality of a session's link.
+type linkQuality struct {
+	mu        sync.Mutex
+	window    time.Duration
+	threshold time.Duration // Stall threshold
+	started   time.Time
+
+	acks []sample
+	rx   []sample
+	ptt  []interval
+	sn   *float64
+
+	rxTotal   int64
+	pttClosed time.Duration // Total duration of PTT intervals no longer in q.ptt
+	activity  time.Time     // Last time data was sent or received
+
+	pending      bool      // Data in the TX buffer
+	lastProgress time.Time // Last time the TX buffer was filled or drained
+	stalls       int
+	stallTime    time.Duration
+}
+
+func newLinkQuality(t Timing, started time.Time) *linkQuality {
+	return &linkQuality{window: t.LinkQualityWindow, threshold: t.StallThreshold, started: started}
+}
+
+// buffer handles a BUFFER report, of which acked bytes were acknowledged over the air.
+func (q *linkQuality) buffer(n, acked int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if acked > 0 {
+		q.acks = prune(append(q.acks, sample{now, acked}), now.Add(-q.window))
+	}
+	switch {
+	case n == 0 || acked > 0:
+		if gap := now.Sub(q.lastProgress); q.pending && gap >= q.threshold {
+			q.stalls++
+			q.stallTime += gap
+		}
+		q.lastProgress = now
+	case !q.pending:
+		// The TX buffer is no longer empty.
+		q.lastProgress = now
+	}
+	q.pending = n > 0
+}
+
+func (q *linkQuality) received(n int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rx = prune(append(q.rx, sample{now, n}), now.Add(-q.window))
+	q.rxTotal += int64(n)
+	q.activity = now
+}
+
+func (q *linkQuality) sent(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.activity = now
+}
+
+// lastActivity returns the last time data was sent or received, or the start of the session.
+func (q *linkQuality) lastActivity() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.activity.IsZero() {
+		return q.started
+	}
+	return q.activity
+}
+
+func (q *linkQuality) setPTT(on bool, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ongoing := len(q.ptt) > 0 && q.ptt[len(q.ptt)-1].end.IsZero()
+	switch {
+	case on && !ongoing:
+		q.ptt = append(q.ptt, interval{start: now})
+	case !on && ongoing:
+		q.ptt[len(q.ptt)-1].end = now
+	}
+	// Drop intervals that ended before the window.
+	from := now.Add(-q.window)
+	for len(q.ptt) > 0 && !q.ptt[0].end.IsZero() && q.ptt[0].end.Before(from) {
+		q.pttClosed += q.ptt[0].end.Sub(q.ptt[0].start)
+		q.ptt = q.ptt[1:]
+	}
+}
+
+// pttTotal returns the total time spent transmitting. The caller must hold q.mu.
+func (q *linkQuality) pttTotal(now time.Time) time.Duration {
+	total := q.pttClosed
+	for _, i := range q.ptt {
+		end := i.end
+		if end.IsZero() {
+			end = now
+		}
+		total += end.Sub(i.start)
+	}
+	return total
+}
+
+func (q *linkQuality) setSN(sn float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.sn = &sn
+}
+
+func (q *linkQuality) snapshot(now time.Time) LinkQuality {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	lq := LinkQuality{Window: q.window, Stalls: q.stalls, StallTime: q.stallTime}
+	if age := now.Sub(q.started); age < lq.Window {
+		lq.Window = age
+	}
+	if q.sn != nil {
+		lq.SN, lq.HasSN = *q.sn, true
+	}
+	if gap := now.Sub(q.lastProgress); q.pending && gap >= q.threshold {
+		lq.Stalled = true
+		lq.Stalls++
+		lq.StallTime += gap
+	}
+	if lq.Window <= 0 {
+		return lq
+	}
+
+	from := now.Add(-lq.Window)
+	lq.TxRate = float64(sum(q.acks, from)) / lq.Window.Seconds()
+	lq.RxRate = float64(sum(q.rx, from)) / lq.Window.Seconds()
+	var tx time.Duration
+	for _, i := range q.ptt {
+		start, end := i.start, i.end
+		if end.IsZero() {
+			end = now
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			tx += end.Sub(start)
+		}
+	}
+	lq.TxDuty = float64(tx) / float64(lq.Window)
+	lq.RxDuty = 1 - lq.TxDuty
+	return lq
+}
+
+// prune removes samples older than from.
+func prune(s []sample, from time.Time) []sample {
+	i := 0
+	for i < len(s) && s[i].t.Before(from) {
+		i++
+	}
+	return s[i:]
+}
+
+// sum returns the sum of samples taken after from.
+func sum(s []sample, from time.Time) (n int) {
+	for _, e := range s {
+		if !e.t.Before(from) {
+			n += e.n
+		}
+	}
+	return n
+}
+
+func parseSN(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(s, "SN ")), 64)
+	return v, err == nil
+}
+
+// LinkQuality returns a snapshot of the current link quality.
+func (v *conn) LinkQuality() LinkQuality {
+	return v.session.quality.snapshot(v.config.Clock.Now())
+}
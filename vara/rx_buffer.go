@@ -0,0 +1,178 @@
+package vara
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// rxBuffer is a thread-safe buffer holding the data received during a single session.
+//
+// It is fed by the modem's data port reader and drained by conn.Read. Once closed, buffered
+// data can still be read before the close error is returned.
+type rxBuffer struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	err      error
+	deadline time.Time
+	changed  chan struct{} // Closed (and replaced) on every state change
+}
+
+func newRxBuffer() *rxBuffer { return &rxBuffer{changed: make(chan struct{})} }
+
+// notify wakes up any blocked readers. The caller must hold b.mu.
+func (b *rxBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// write appends p to the buffer. It returns false if the buffer is closed.
+func (b *rxBuffer) write(p []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return false
+	}
+	b.buf.Write(p)
+	b.notify()
+	return true
+}
+
+// closeWithError closes the buffer for writing. Read returns err once the remaining data is drained.
+func (b *rxBuffer) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return
+	}
+	b.err = err
+	b.notify()
+}
+
+// discard closes the buffer and drops any data not yet read, returning the number of bytes dropped.
+func (b *rxBuffer) discard(err error) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.buf.Len()
+	b.buf.Reset()
+	if b.err == nil {
+		b.err = err
+	}
+	b.notify()
+	return n
+}
+
+// len returns the number of unread bytes.
+func (b *rxBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Len()
+}
+
+func (b *rxBuffer) setDeadline(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	b.notify()
+}
+
+// Read reads buffered data, blocking until data is available, the buffer is closed or the read
+// deadline is exceeded.
+func (b *rxBuffer) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if err := b.wait(); err != nil {
+			return 0, err
+		}
+		b.mu.Lock()
+		if b.buf.Len() == 0 {
+			// Discarded while we were waiting for the lock.
+			b.mu.Unlock()
+			continue
+		}
+		n, _ := b.buf.Read(p)
+		b.mu.Unlock()
+		return n, nil
+	}
+}
+
+// WriteTo writes buffered data to w until the buffer is closed, the read deadline is exceeded or an
+// error occurs when writing. It returns nil if the buffer was closed with io.EOF.
+//
+// All data available at any time is written to w in a single call.
+func (b *rxBuffer) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var p []byte
+	for {
+		if err := b.wait(); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		b.mu.Lock()
+		p = append(p[:0], b.buf.Bytes()...)
+		b.buf.Reset()
+		b.mu.Unlock()
+		if len(p) == 0 {
+			// Discarded while we were waiting for the lock.
+			continue
+		}
+
+		m, err := w.Write(p)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// wait blocks until data is available, returning nil, or until the buffer is drained and closed
+// or the read deadline is exceeded, returning the corresponding error.
+func (b *rxBuffer) wait() error {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		b.mu.Lock()
+		switch {
+		case b.buf.Len() > 0:
+			b.mu.Unlock()
+			return nil
+		case b.err != nil:
+			b.mu.Unlock()
+			return b.err
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			b.mu.Unlock()
+			return os.ErrDeadlineExceeded
+		}
+		changed, deadline := b.changed, b.deadline
+		b.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			if timer == nil {
+				timer = time.NewTimer(time.Until(deadline))
+			} else {
+				timer.Reset(time.Until(deadline))
+			}
+			timeout = timer.C
+		}
+		select {
+		case <-changed:
+			if timer != nil && !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timeout:
+		}
+	}
+}
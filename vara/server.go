@@ -0,0 +1,260 @@
+package vara
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// A Handler serves an inbound connection.
+//
+// The connection is closed when ServeVARA returns.
+type Handler interface {
+	ServeVARA(conn net.Conn)
+}
+
+// HandlerFunc is an adapter allowing the use of ordinary functions as handlers.
+type HandlerFunc func(conn net.Conn)
+
+// ServeVARA calls f(conn).
+func (f HandlerFunc) ServeVARA(conn net.Conn) { f(conn) }
+
+// ServeMux routes inbound connections to handlers by the remote callsign.
+//
+// Patterns are callsign patterns as described by AdmissionPolicy, and are matched in the order
+// they were registered. Connections not matching any pattern are closed.
+type ServeMux struct {
+	mu      sync.RWMutex
+	entries []muxEntry
+}
+
+type muxEntry struct {
+	pattern string
+	handler Handler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux { return new(ServeMux) }
+
+// Handle registers the handler for connections from callsigns matching pattern.
+func (mux *ServeMux) Handle(pattern string, handler Handler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.entries = append(mux.entries, muxEntry{pattern, handler})
+}
+
+// HandleFunc registers the handler function for connections from callsigns matching pattern.
+func (mux *ServeMux) HandleFunc(pattern string, handler func(conn net.Conn)) {
+	mux.Handle(pattern, HandlerFunc(handler))
+}
+
+// Handler returns the handler for connections from call, or nil if no pattern matches.
+func (mux *ServeMux) Handler(call string) Handler {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	for _, e := range mux.entries {
+		if matchCall(e.pattern, call) {
+			return e.handler
+		}
+	}
+	return nil
+}
+
+// ServeVARA dispatches the connection to the handler matching the remote callsign.
+func (mux *ServeMux) ServeVARA(conn net.Conn) {
+	h := mux.Handler(conn.RemoteAddr().String())
+	if h == nil {
+		connLogger(conn).Debug("No handler for connection")
+		return
+	}
+	h.ServeVARA(conn)
+}
+
+// Server serves inbound connections, in the fashion of http.Server.
+type Server struct {
+	// Handler serves each accepted connection.
+	Handler Handler
+	// ListenConfig is used by ListenAndServe.
+	ListenConfig ListenConfig
+	// SessionStartFunc is called before a connection is handed to the Handler; optional.
+	SessionStartFunc func(conn net.Conn)
+	// SessionEndFunc is called after the Handler returned and the connection is closed; optional.
+	SessionEndFunc func(conn net.Conn)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	active    map[net.Conn]struct{}
+	wg        sync.WaitGroup
+	shutdown  bool
+}
+
+// ListenAndServe listens on the modem using srv.ListenConfig and serves inbound connections.
+//
+// It always returns a non-nil error. After Shutdown or Close, the returned error is ErrServerClosed.
+func (srv *Server) ListenAndServe(m *Modem) error {
+	ln, err := srv.ListenConfig.Listen(m)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// Serve accepts inbound connections on the listener, handing each one to srv.Handler in a new goroutine.
+// The listener is closed when Serve returns.
+//
+// It always returns a non-nil error. After Shutdown or Close, the returned error is ErrServerClosed.
+func (srv *Server) Serve(ln net.Listener) error {
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !srv.trackConn(conn, true) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go srv.serveConn(conn)
+	}
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	defer srv.trackConn(conn, false)
+	defer func() {
+		if fn := srv.SessionEndFunc; fn != nil {
+			fn(conn)
+		}
+	}()
+	defer conn.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			connLogger(conn).Error("Panic serving connection", "panic", err, "stack", string(debug.Stack()))
+		}
+	}()
+	if fn := srv.SessionStartFunc; fn != nil {
+		fn(conn)
+	}
+	srv.Handler.ServeVARA(conn)
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners, and waits for the active
+// sessions to finish.
+//
+// If the context is cancelled first, the active connections are closed (aborting the link if the
+// connection supports CloseContext) and the context's error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.closeListeners()
+
+	done := make(chan struct{})
+	go func() { srv.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		srv.closeConns(ctx)
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes all listeners and active connections.
+func (srv *Server) Close() error {
+	err := srv.closeListeners()
+	srv.closeConns(context.Background())
+	return err
+}
+
+func (srv *Server) closeListeners() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.shutdown = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (srv *Server) closeConns(ctx context.Context) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for conn := range srv.active {
+		if c, ok := conn.(interface{ CloseContext(context.Context) error }); ok {
+			go c.CloseContext(ctx)
+		} else {
+			go conn.Close()
+		}
+	}
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.shutdown
+}
+
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	if !add {
+		delete(srv.listeners, ln)
+		return true
+	}
+	if srv.shutdown {
+		return false
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackConn(conn net.Conn, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.active == nil {
+		srv.active = make(map[net.Conn]struct{})
+	}
+	if !add {
+		delete(srv.active, conn)
+		srv.wg.Done()
+		return true
+	}
+	if srv.shutdown {
+		return false
+	}
+	srv.active[conn] = struct{}{}
+	srv.wg.Add(1)
+	return true
+}
+
+// loggerConn is a connection carrying its own Logger, like the connections of this package.
+type loggerConn interface {
+	sessionLogger() Logger
+}
+
+// sessionLogger returns the Logger of the connection's session.
+func (v *conn) sessionLogger() Logger { return v.session.log }
+
+// connLogger returns the Logger of conn, or the default Logger if conn doesn't carry one.
+func connLogger(c net.Conn) Logger {
+	if c, ok := c.(loggerConn); ok {
+		return c.sessionLogger()
+	}
+	return withFields(stdLogger{}, "remote", c.RemoteAddr())
+}
@@ -0,0 +1,83 @@
+package vara
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pipeConn struct {
+	net.Conn
+	remote string
+	log    Logger
+}
+
+func (c pipeConn) RemoteAddr() net.Addr  { return Addr{c.remote} }
+func (c pipeConn) sessionLogger() Logger { return c.log }
+
+type chanListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (ln chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case <-ln.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (ln chanListener) Close() error {
+	select {
+	case <-ln.done:
+	default:
+		close(ln.done)
+	}
+	return nil
+}
+
+func (ln chanListener) Addr() net.Addr { return Addr{"N0CALL"} }
+
+func TestServer(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("LA5NTA-*", func(c net.Conn) { io.WriteString(c, "hello "+c.RemoteAddr().String()) })
+	mux.HandleFunc("*", func(c net.Conn) { panic("unexpected caller") })
+
+	// The recovered panic is logged to the conn's Logger.
+	var logger recordingLogger
+
+	ln := chanListener{conns: make(chan net.Conn), done: make(chan struct{})}
+	srv := &Server{Handler: mux}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	dial := func(call string) string {
+		client, server := net.Pipe()
+		ln.conns <- pipeConn{server, call, &logger}
+		b, _ := io.ReadAll(client)
+		return string(b)
+	}
+	if got := dial("LA5NTA-1"); got != "hello LA5NTA-1" {
+		t.Errorf("unexpected response: %q", got)
+	}
+	if got := dial("N0CALL"); got != "" {
+		t.Errorf("unexpected response: %q", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "ERROR Panic serving connection") {
+		t.Errorf("expected the panic to be logged, got %q", logger.lines)
+	}
+}
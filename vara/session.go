@@ -0,0 +1,171 @@
+package vara
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// session holds the state of a single link, from CONNECTED until DISCONNECTED.
+type session struct {
+	id         uint64 // Sequence number, unique within the modem
+	log        Logger // Logger with session fields
+	remoteCall string
+	inbound    bool
+	bandwidth  string // Negotiated bandwidth as reported by VARA (e.g. "2300" or "WIDE")
+	rx         *rxBuffer
+	progress   progress
+	quality    *linkQuality
+
+	// Guarded by Modem.sessionMu
+	ended   bool
+	endedAt time.Time
+	end     EndReason
+	expired error   // Set if a session limit was exceeded
+	timers  []Timer // Stopped when the session ends
+}
+
+// startSession starts a new session, replacing the previous one.
+//
+// Any late data still buffered from the previous session will never be mixed with the new one.
+func (m *Modem) startSession(remoteCall, bandwidth string, inbound bool) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if m.session != nil {
+		m.session.rx.closeWithError(io.EOF)
+	}
+	m.sessionSeq++
+	m.session = &session{
+		id:         m.sessionSeq,
+		log:        withFields(m.logger, "remote", remoteCall, "session", m.sessionSeq),
+		remoteCall: remoteCall,
+		inbound:    inbound,
+		bandwidth:  bandwidth,
+		rx:         newRxBuffer(),
+		quality:    newLinkQuality(m.config.Timing, m.config.Clock.Now()),
+	}
+	if len(m.early) > 0 {
+		// VARA sent data right after CONNECTED, but it was read before the command.
+		m.session.rx.write(m.early)
+		m.session.quality.received(len(m.early), m.config.Clock.Now())
+		m.early = nil
+	}
+}
+
+// endSession ends the current session, reporting its stats to ModemConfig.SessionStatsFunc.
+func (m *Modem) endSession() {
+	m.sessionMu.Lock()
+	m.early = nil // Anything held was meant for a session that's now over
+	if m.session == nil || m.session.ended {
+		m.sessionMu.Unlock()
+		return
+	}
+	now := m.config.Clock.Now()
+	m.session.quality.setPTT(false, now)
+	m.session.ended, m.session.endedAt = true, now
+	stats := m.session.stats(now)
+	for _, t := range m.session.timers {
+		t.Stop()
+	}
+
+	// Workaround for race condition between cmd and data conn.
+	// The data was of course sent before the DISCONNECTED, but they are received
+	// out of order since they're sent from the modem on independent streams.
+	// Keep the session's receive buffer open for a little while to catch any late data.
+	rx, logger := m.session.rx, m.session.log
+	m.config.Clock.AfterFunc(m.config.Timing.LateDataWindow, func() { rx.closeWithError(io.EOF) })
+	m.sessionMu.Unlock()
+
+	logger.Debug("Session ended", "end", stats.End, "duration", stats.Duration, "sent", stats.BytesSent, "received", stats.BytesReceived)
+	if fn := m.config.SessionStatsFunc; fn != nil {
+		fn(stats)
+	}
+}
+
+// currentSession returns the current (or last) session.
+func (m *Modem) currentSession() *session {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if m.session == nil {
+		// No session has been established yet.
+		rx := newRxBuffer()
+		rx.closeWithError(io.EOF)
+		return &session{log: m.logger, rx: rx, quality: newLinkQuality(m.config.Timing, m.config.Clock.Now())}
+	}
+	return m.session
+}
+
+// activeSession returns the current session, or nil if the link is disconnected.
+func (m *Modem) activeSession() *session {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if m.session == nil || m.session.ended {
+		return nil
+	}
+	return m.session
+}
+
+// goroutine reading the data port for the lifetime of the TNC connection, feeding the current
+// session's receive buffer.
+func (m *Modem) dataListen(cmdConn, dataConn net.Conn) {
+	m.sessionMu.Lock()
+	m.early = nil // Anything held is from a previous TNC connection
+	m.sessionMu.Unlock()
+
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := dataConn.Read(buf)
+		if n > 0 {
+			m.captureRecord(CaptureDataIn, buf[:n])
+			m.sessionMu.Lock()
+			if m.session != nil && m.session.rx.write(buf[:n]) {
+				m.session.quality.received(n, m.config.Clock.Now())
+			} else {
+				m.holdEarlyData(buf[:n])
+			}
+			m.sessionMu.Unlock()
+		}
+		if err != nil {
+			m.logger.Debug("Reading data failed", "error", err)
+			if m.isClosed() || !m.config.Reconnect {
+				m.sessionMu.Lock()
+				if m.session != nil {
+					m.session.rx.closeWithError(ErrModemClosed)
+				}
+				m.sessionMu.Unlock()
+			}
+			// The TNC connection is useless without the data port.
+			cmdConn.Close()
+			return
+		}
+	}
+}
+
+// maxEarlyData is the maximum amount of data held for a session that's not started yet.
+const maxEarlyData = 64 << 10
+
+// holdEarlyData holds data received outside of a session for the next session, if a CONNECTED
+// may be pending. Otherwise the data is discarded.
+//
+// The data and command ports are independent streams, so data sent right after CONNECTED may be
+// read before the command is handled. The caller must hold m.sessionMu.
+func (m *Modem) holdEarlyData(p []byte) {
+	switch {
+	case !m.connectPending():
+		m.logger.Debug("Discarding data received outside of a session", "bytes", len(p))
+	case len(m.early)+len(p) > maxEarlyData:
+		m.logger.Debug("Discarding data received before CONNECTED", "bytes", len(p))
+	default:
+		m.early = append(m.early, p...)
+	}
+}
+
+// connectPending returns true if no session is active, and a CONNECTED may be pending: we're
+// dialing, listening or handling the command. The caller must hold m.sessionMu.
+func (m *Modem) connectPending() bool {
+	if m.session != nil && !m.session.ended {
+		// The session's receive buffer was closed by Close.
+		return false
+	}
+	return m.state() != disconnected || m.currentListener() != nil
+}
@@ -0,0 +1,118 @@
+package vara
+
+import "time"
+
+// EndReason describes how a session ended.
+type EndReason int
+
+const (
+	// EndRemote means the link was disconnected by the remote station (or by VARA).
+	EndRemote EndReason = iota
+	// EndGraceful means the link was gracefully disconnected by us.
+	EndGraceful
+	// EndAbort means the link was aborted.
+	EndAbort
+	// EndTimeout means the link was aborted after a timeout.
+	EndTimeout
+	// EndRejected means the inbound link was rejected by the listener's admission policy.
+	EndRejected
+)
+
+func (r EndReason) String() string {
+	switch r {
+	case EndRemote:
+		return "remote"
+	case EndGraceful:
+		return "graceful"
+	case EndAbort:
+		return "abort"
+	case EndTimeout:
+		return "timeout"
+	case EndRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// SessionStats summarizes a session.
+type SessionStats struct {
+	RemoteCall string
+	// Inbound is true if the session was initiated by the remote station.
+	Inbound bool
+	// Bandwidth is the negotiated bandwidth as reported by VARA (e.g. "2300" or "WIDE").
+	Bandwidth string
+	// Connected is the time the link was established.
+	Connected time.Time
+	// Duration is the time the link has been (or was) connected.
+	Duration time.Duration
+	// BytesSent is the number of bytes written to the modem.
+	BytesSent int64
+	// BytesReceived is the number of bytes received from the remote station.
+	BytesReceived int64
+	// BytesAcked is the number of bytes acknowledged by the remote station over the air.
+	BytesAcked int64
+	// PTTTime is the total time spent transmitting.
+	PTTTime time.Duration
+	// BufferStalls is the number of times the TX buffer stalled (see Timing.StallThreshold).
+	BufferStalls int
+	// Ended is true if the session has ended, in which case End describes how.
+	Ended bool
+	End   EndReason
+}
+
+// SessionStatsFunc is a function that is called with the stats of each session when it ends.
+//
+// It may be called from any goroutine, including the command reader and the goroutine closing or
+// aborting the connection. It must not block, nor call back into the Modem.
+type SessionStatsFunc func(SessionStats)
+
+// stats returns the stats of the session as of now. The caller must hold Modem.sessionMu.
+func (s *session) stats(now time.Time) SessionStats {
+	if s.ended {
+		now = s.endedAt
+	}
+	lq := s.quality.snapshot(now)
+	s.progress.mu.Lock()
+	written, acked := s.progress.written, s.progress.acked
+	s.progress.mu.Unlock()
+	s.quality.mu.Lock()
+	received, pttTime := s.quality.rxTotal, s.quality.pttTotal(now)
+	s.quality.mu.Unlock()
+	return SessionStats{
+		RemoteCall:    s.remoteCall,
+		Inbound:       s.inbound,
+		Bandwidth:     s.bandwidth,
+		Connected:     s.quality.started,
+		Duration:      now.Sub(s.quality.started),
+		BytesSent:     written,
+		BytesReceived: received,
+		BytesAcked:    acked,
+		PTTTime:       pttTime,
+		BufferStalls:  lq.Stalls,
+		Ended:         s.ended,
+		End:           s.end,
+	}
+}
+
+// setEndReason records how the current session is about to end.
+//
+// A reason is only replaced by a more severe one, so that e.g. a graceful disconnect that times
+// out and is aborted is reported as a timeout.
+func (m *Modem) setEndReason(r EndReason) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if m.session == nil || m.session.ended || r <= m.session.end {
+		return
+	}
+	m.session.end = r
+}
+
+// Stats returns the stats of the connection's session.
+//
+// The stats are final once the link is disconnected.
+func (v *conn) Stats() SessionStats {
+	v.sessionMu.Lock()
+	defer v.sessionMu.Unlock()
+	return v.session.stats(v.config.Clock.Now())
+}
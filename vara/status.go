@@ -0,0 +1,249 @@
+package vara
+
+import (
+	"strings"
+	"time"
+)
+
+// eventBuffer is the number of events buffered for slow receivers before events are dropped.
+const eventBuffer = 32
+
+// State is the link state of the modem.
+type State int
+
+const (
+	// StateDisconnected means the modem is idle.
+	StateDisconnected State = iota
+	// StateConnecting means the modem is dialing.
+	StateConnecting
+	// StateConnected means a link is established.
+	StateConnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return "unknown"
+	}
+}
+
+// Status is a snapshot of the modem's state.
+type Status struct {
+	// State is the link state
+	State State
+	// RemoteCall is the callsign of the remote station, while connected
+	RemoteCall string
+	// Bandwidth is the bandwidth of the link while connected, otherwise the default bandwidth (if set)
+	Bandwidth string
+	// Inbound is true if the link was established by the remote station
+	Inbound bool
+	// Busy is true if the channel is not clear
+	Busy bool
+	// PTT is true while VARA is transmitting
+	PTT bool
+	// TxBuffer is the number of bytes in VARA's TX buffer
+	TxBuffer int
+	// Listening is true if inbound connections are enabled
+	Listening bool
+	// Registered is the callsign VARA reported to be registered to, if any
+	Registered string
+	// Version is the version of the VARA modem program, if known
+	Version string
+	// TNCAvailable is true while the modem is connected to the VARA modem program
+	TNCAvailable bool
+}
+
+// Status returns a snapshot of the modem's state.
+func (m *Modem) Status() Status {
+	m.statusMu.Lock()
+	s := Status{
+		State:      publicState(m.connectedState),
+		Bandwidth:  m.bandwidth,
+		Busy:       m.busy,
+		PTT:        m.ptt,
+		Listening:  m.activeListener != nil,
+		Registered: m.registered,
+		Version:    m.version,
+	}
+	m.statusMu.Unlock()
+	s.TxBuffer, s.TNCAvailable = m.bufferCount.get(), m.Ping()
+	if sess := m.activeSession(); sess != nil && s.State == StateConnected {
+		s.RemoteCall, s.Inbound = sess.remoteCall, sess.inbound
+		if sess.bandwidth != "" {
+			s.Bandwidth = sess.bandwidth
+		}
+	}
+	return s
+}
+
+// setStatus applies fn while holding statusMu.
+func (m *Modem) setStatus(fn func()) {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	fn()
+}
+
+// state returns the link state.
+func (m *Modem) state() connectedState {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.connectedState
+}
+
+// defaultBandwidth returns the bandwidth set by SetBandwidth, if any.
+func (m *Modem) defaultBandwidth() string {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.bandwidth
+}
+
+// currentListener returns the active listener, or nil if not listening.
+func (m *Modem) currentListener() *listener {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	return m.activeListener
+}
+
+func publicState(s connectedState) State {
+	switch s {
+	case connected:
+		return StateConnected
+	case connecting:
+		return StateConnecting
+	default:
+		return StateDisconnected
+	}
+}
+
+// EventType identifies the kind of state change of an Event.
+type EventType int
+
+const (
+	// EventConnected is sent when a link is established.
+	EventConnected EventType = iota
+	// EventDisconnected is sent when a link is disconnected.
+	EventDisconnected
+	// EventBusy is sent when the channel becomes busy or clear.
+	EventBusy
+	// EventPTT is sent when VARA starts or stops transmitting.
+	EventPTT
+	// EventBuffer is sent when the TX buffer count changes.
+	EventBuffer
+	// EventRegistered is sent when VARA reports the callsign it's registered to.
+	EventRegistered
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventBusy:
+		return "busy"
+	case EventPTT:
+		return "ptt"
+	case EventBuffer:
+		return "buffer"
+	case EventRegistered:
+		return "registered"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change of the modem's state.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Status is the modem's state right after the change
+	Status Status
+}
+
+// eventTypes maps command prefixes to the event types they cause.
+var eventTypes = []struct {
+	prefix string
+	typ    EventType
+}{
+	{"CONNECTED", EventConnected},
+	{"DISCONNECTED", EventDisconnected},
+	{"BUSY", EventBusy},
+	{"PTT", EventPTT},
+	{"BUFFER", EventBuffer},
+	{"REGISTERED", EventRegistered},
+}
+
+// Events subscribes to changes of the modem's state. Events are delivered in order until cancel is
+// called or the modem is closed, after which the channel is closed.
+//
+// Events are dropped if the receiver falls behind, so the modem is never blocked by a slow receiver.
+func (m *Modem) Events() (events <-chan Event, cancel func()) {
+	out := make(chan Event, eventBuffer)
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if m.eventsClosed {
+		close(out)
+		return out, func() {}
+	}
+	if m.eventSubs == nil {
+		m.eventSubs = make(map[chan Event]struct{})
+	}
+	m.eventSubs[out] = struct{}{}
+	return out, func() {
+		m.eventsMu.Lock()
+		defer m.eventsMu.Unlock()
+		if _, ok := m.eventSubs[out]; ok {
+			delete(m.eventSubs, out)
+			close(out)
+		}
+	}
+}
+
+// publishEvent sends the event caused by the command cmd, if any, to the subscribers. It's called
+// once the command is handled, so the event carries the state right after the change.
+func (m *Modem) publishEvent(cmd string) {
+	typ, ok := eventType(cmd)
+	if !ok {
+		return
+	}
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if len(m.eventSubs) == 0 {
+		return
+	}
+	ev := Event{Type: typ, Time: m.config.Clock.Now(), Status: m.Status()}
+	for out := range m.eventSubs {
+		select {
+		case out <- ev:
+		default:
+			m.logger.Debug("Event receiver falling behind, dropped event", "event", typ)
+		}
+	}
+}
+
+// eventType returns the type of the event caused by the command cmd, if any.
+func eventType(cmd string) (EventType, bool) {
+	for _, e := range eventTypes {
+		if strings.HasPrefix(cmd, e.prefix) {
+			return e.typ, true
+		}
+	}
+	return 0, false
+}
+
+// closeEvents closes the channels of all subscribers, when the modem is closed.
+func (m *Modem) closeEvents() {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	m.eventsClosed = true
+	for out := range m.eventSubs {
+		close(out)
+	}
+	m.eventSubs = nil
+}
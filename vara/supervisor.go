@@ -0,0 +1,150 @@
+package vara
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// tncLost handles loss of the TCP connections with the VARA modem program.
+//
+// Unless ModemConfig.Reconnect is set, the modem is closed.
+func (m *Modem) tncLost(err error) {
+	if m.isClosed() {
+		return
+	}
+	if !m.config.Reconnect {
+		m.Close()
+		return
+	}
+	m.closeConns()
+	if m.proc != nil {
+		// Make sure a wedged program is restarted.
+		m.proc.stop()
+	}
+
+	// Any active link is lost with the TNC.
+	if m.state() != disconnected {
+		m.setEndReason(EndAbort)
+		m.cmds.Publish("DISCONNECTED")
+		m.handleDisconnected()
+		m.publishEvent("DISCONNECTED")
+	}
+	m.setStatus(func() { m.busy, m.ptt = false, false })
+	m.sendPTT(false)
+
+	m.logger.Error("VARA modem connection lost", "error", err)
+	if fn := m.config.TNCLostFunc; fn != nil {
+		fn(err)
+	}
+	go m.reconnect()
+}
+
+// reconnect attempts to (re-)establish the TCP connections with the VARA modem program, with
+// exponential backoff, until successful or the modem is closed.
+func (m *Modem) reconnect() {
+	backoff := m.config.Timing.ReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		err := m.start()
+		if err == nil {
+			break
+		}
+		if err == ErrModemClosed {
+			return
+		}
+		m.logger.Debug("Connect attempt failed", "attempt", attempt, "error", err)
+
+		wait, stop := m.after(backoff)
+		select {
+		case <-wait:
+		case <-m.done:
+			stop()
+			return
+		}
+		if backoff *= 2; backoff > m.config.Timing.ReconnectMaxBackoff {
+			backoff = m.config.Timing.ReconnectMaxBackoff
+		}
+	}
+
+	m.logger.Info("VARA modem connection established")
+	if fn := m.config.TNCRestoredFunc; fn != nil {
+		fn()
+	}
+}
+
+// waitTNC blocks until the VARA modem program is available if ModemConfig.WaitForTNC is set.
+// Otherwise it returns ErrTNCUnavailable if it's not available.
+func (m *Modem) waitTNC(ctx context.Context) error {
+	m.connMu.Lock()
+	ready := m.tncReady
+	m.connMu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	default:
+		if m.isClosed() {
+			return ErrModemClosed
+		}
+		if !m.config.WaitForTNC {
+			return ErrTNCUnavailable
+		}
+	}
+
+	m.logger.Debug("Waiting for TNC...")
+	select {
+	case <-ready:
+		return nil
+	case <-m.done:
+		return ErrModemClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeConns closes the TCP connections with the VARA modem program.
+func (m *Modem) closeConns() {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	select {
+	case <-m.tncReady:
+		m.tncReady = make(chan struct{})
+	default:
+	}
+	m.health.disconnected()
+	m.cmdConn = m.disconnectTCP("command", m.cmdConn)
+	m.dataConn = m.disconnectTCP("data", m.dataConn)
+}
+
+// writeData writes to the data port.
+func (m *Modem) writeData(b []byte) (int, error) {
+	dataConn, err := m.currentDataConn()
+	if err != nil {
+		return 0, err
+	}
+	n, err := dataConn.Write(b)
+	if n > 0 {
+		m.captureRecord(CaptureDataOut, b[:n])
+	}
+	return n, err
+}
+
+// setDataWriteDeadline sets the write deadline of the data port.
+func (m *Modem) setDataWriteDeadline(t time.Time) error {
+	dataConn, err := m.currentDataConn()
+	if err != nil {
+		return err
+	}
+	return dataConn.SetWriteDeadline(t)
+}
+
+func (m *Modem) currentDataConn() (net.Conn, error) {
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	switch {
+	case m.isClosed():
+		return nil, ErrModemClosed
+	case m.dataConn == nil:
+		return nil, ErrTNCUnavailable
+	}
+	return m.dataConn, nil
+}
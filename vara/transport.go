@@ -2,11 +2,9 @@ package vara
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net"
 	"strings"
-	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
 )
@@ -25,13 +23,23 @@ func (m *Modem) DialURLContext(ctx context.Context, url *transport.URL) (net.Con
 	if url.Scheme != m.scheme {
 		return nil, transport.ErrUnsupportedScheme
 	}
-	if m.closed {
+	if m.isClosed() {
 		return nil, ErrModemClosed
 	}
+	if err := m.waitTNC(ctx); err == ErrTNCUnavailable {
+		return nil, &OpError{Op: "dial", Target: url.Target, Err: err}
+	} else if err != nil {
+		return nil, err
+	}
 
 	// TODO: Handle race condition here. Should prevent concurrent dialing.
-	if m.connectedState != disconnected {
-		return nil, errors.New("modem busy")
+	if m.state() != disconnected {
+		return nil, &OpError{Op: "dial", Target: url.Target, Err: ErrModemBusy}
+	}
+
+	limits, err := m.urlLimits(url)
+	if err != nil {
+		return nil, err
 	}
 
 	// Set temporary bandwidth from the URL
@@ -56,14 +64,16 @@ func (m *Modem) DialURLContext(ctx context.Context, url *transport.URL) (net.Con
 	}
 
 	// Handle busy channel with BusyFunc if provided.
+	start := m.config.Clock.Now()
 	if m.busyFunc != nil {
 		if abort := m.waitIfBusy(ctx, m.busyFunc); abort {
-			return nil, fmt.Errorf("aborted while waiting for clear channel")
+			return nil, &OpError{Op: "dial", Target: url.Target, Elapsed: m.config.Clock.Now().Sub(start), Err: ErrChannelBusy}
 		}
 	}
 
 	// Start connecting
-	m.connectedState = connecting
+	start = m.config.Clock.Now()
+	m.setStatus(func() { m.connectedState = connecting })
 	cmds, cancel := m.cmds.Subscribe("CONNECTED", "DISCONNECTED")
 	defer cancel()
 	if err := m.writeCmd(fmt.Sprintf("CONNECT %s %s", m.myCall, url.Target)); err != nil {
@@ -78,10 +88,10 @@ func (m *Modem) DialURLContext(ctx context.Context, url *transport.URL) (net.Con
 	go func() {
 		select {
 		case <-ctx.Done():
-			debugPrint("context cancellation - sending disconnect command...")
+			m.logger.Debug("Context cancelled, sending disconnect command...", "remote", url.Target)
 			m.writeCmd("DISCONNECT")
 		case <-done:
-			debugPrint("dial completed - context cancellation no longer possible")
+			m.logger.Debug("Dial completed, context cancellation no longer possible", "remote", url.Target)
 		}
 	}()
 
@@ -94,39 +104,55 @@ func (m *Modem) DialURLContext(ctx context.Context, url *transport.URL) (net.Con
 		//         Should the newState include remote address?
 		//         Or maybe the complete command string instead of this enum?
 		// Hand the VARA data TCP port to the client code
-		return m.newConn(url.Target), nil
+		conn := m.newConn(url.Target)
+		conn.enforceLimits(limits)
+		return conn, nil
 	case ctx.Err() != nil:
 		// DISCONNECTED after context cancellation.
 		return nil, ctx.Err()
 	default:
 		// DISCONNECTED for some other reason. Most likely a timeout.
-		return nil, errors.New("connect timeout")
+		return nil, &OpError{Op: "dial", Target: url.Target, Elapsed: m.config.Clock.Now().Sub(start), Err: ErrConnectTimeout}
 	}
 }
 
 // Disconnect gracefully closes any active connection, blocking until the link is disconnected.
 //
 // If the modem is not connected, this is a no-op.
-func (m *Modem) Disconnect() error {
+func (m *Modem) Disconnect() error { return m.DisconnectContext(context.Background()) }
+
+// DisconnectContext is like Disconnect, but returns ctx.Err() if the context is cancelled before the
+// link is disconnected. The link is left as is, use Abort() to disconnect immediately.
+func (m *Modem) DisconnectContext(ctx context.Context) error {
 	ack, cancel := m.cmds.Subscribe("DISCONNECTED")
 	defer cancel()
-	if m.connectedState == disconnected {
+	if m.state() == disconnected {
 		return nil
 	}
+	m.setEndReason(EndGraceful)
 	if err := m.writeCmd("DISCONNECT"); err != nil {
 		return err
 	}
-	<-ack
-	return nil
+	select {
+	case _, ok := <-ack:
+		if !ok {
+			return ErrModemClosed
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Abort disconnects the link immediately.
 func (m *Modem) Abort() error {
+	m.setEndReason(EndAbort)
 	err := m.writeCmd("ABORT")
 	// VARA does not send a DISCONNECTED state change after ABORT if it's
 	// already in the process of disconnecting, so we have to fake it.
 	m.cmds.Publish("DISCONNECTED")
 	m.handleDisconnected()
+	m.publishEvent("DISCONNECTED")
 	return err
 }
 
@@ -151,6 +177,8 @@ func contains(c []string, s string) bool {
 
 // Busy returns true if the channel is not clear.
 func (m *Modem) Busy() bool {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
 	return m.busy
 }
 
@@ -174,7 +202,12 @@ func (m *Modem) waitIfBusy(ctx context.Context, busyFunc BusyFunc) (abort bool)
 	go func() {
 		defer cancel()
 		for m.Busy() && ctx.Err() == nil {
-			time.Sleep(300 * time.Millisecond)
+			poll, stop := m.after(m.config.Timing.BusyPollInterval)
+			select {
+			case <-poll:
+			case <-ctx.Done():
+				stop()
+			}
 		}
 	}()
 
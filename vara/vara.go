@@ -4,10 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dario.cat/mergo"
@@ -29,31 +29,148 @@ type ModemConfig struct {
 	// DataPort is the TCP port on which to exchange over-the-air payloads with VARA;
 	// defaults to 8301
 	DataPort int
+	// Timing defines timeouts and intervals; zero values are replaced with defaults
+	Timing Timing
+	// Clock is the source of time for all timers; defaults to the system clock
+	Clock Clock
+	// IdleTimeout is the maximum time a connection can be idle (no data sent or received) before it
+	// is closed; zero means no limit. It can be overridden per dial with the idle_timeout URL parameter.
+	IdleTimeout time.Duration
+	// MaxSessionDuration is the maximum duration of a connection before it is closed; zero means no
+	// limit. It can be overridden per dial with the max_duration URL parameter.
+	MaxSessionDuration time.Duration
+	// DeferStart makes NewModem return immediately, connecting to the VARA modem program in the
+	// background (retrying as with Reconnect) instead of failing if it's not running.
+	DeferStart bool
+	// WaitForTNC makes dialing block until the VARA modem program is available (or the context is
+	// cancelled), and allows listening before it's available. If false, these operations fail
+	// with ErrTNCUnavailable.
+	WaitForTNC bool
+	// Reconnect enables automatic reconnection to the VARA modem program if the connection is lost
+	// (e.g. when VARA is restarted). If false, the modem is closed when the connection is lost.
+	Reconnect bool
+	// DialContext is used to connect to the command and data ports, e.g. through a tunnel or proxy
+	// (see SOCKS5Dialer); defaults to dialing TCP directly
+	DialContext DialFunc
+	// Process configures a VARA modem program to be launched and supervised by the modem; optional.
+	// It implies Reconnect.
+	Process *ProcessConfig
+	// TNCLostFunc is called when the connection to the VARA modem program is lost; optional.
+	TNCLostFunc func(err error)
+	// TNCRestoredFunc is called when the connection to the VARA modem program is restored, or
+	// established in the background with DeferStart; optional.
+	TNCRestoredFunc func()
+	// Capture configures recording of all traffic with VARA to a file; optional
+	Capture *CaptureConfig
+	// Logger receives the modem's log messages; defaults to the standard logger, with debug messages
+	// written to stderr if the VARA_DEBUG environment variable is set
+	Logger Logger
+	// SessionStatsFunc is called with the stats of each session when it ends; optional
+	SessionStatsFunc SessionStatsFunc
+}
+
+// Timing defines the timeouts and intervals used when interacting with the VARA modem.
+type Timing struct {
+	// CmdWriteTimeout is the deadline for writing a command to VARA; defaults to 5 seconds
+	CmdWriteTimeout time.Duration
+	// AliveTimeout is how long to wait for any command from VARA before assuming the modem is lost;
+	// defaults to 2 minutes (VARA sends IAMALIVE every 60 seconds)
+	AliveTimeout time.Duration
+	// BufferTimeout is how long Write and Flush wait for the TX buffer to drain without any BUFFER
+	// update before giving up; defaults to 1 minute
+	BufferTimeout time.Duration
+	// DisconnectTimeout is how long to wait for a graceful disconnect before aborting the link;
+	// defaults to 60 seconds
+	DisconnectTimeout time.Duration
+	// WriteSettleTime is the minimum time between the last write and DISCONNECT, making sure the
+	// written data has reached VARA before disconnecting; defaults to 2 seconds
+	WriteSettleTime time.Duration
+	// LateDataWindow is how long data received after DISCONNECTED is still delivered to the
+	// connection; defaults to 2 seconds
+	LateDataWindow time.Duration
+	// BusyPollInterval is how often a busy channel is checked for clearance; defaults to 300ms
+	BusyPollInterval time.Duration
+	// ReconnectBackoff is the initial delay between reconnect attempts, doubled on each failed
+	// attempt; defaults to 1 second
+	ReconnectBackoff time.Duration
+	// ReconnectMaxBackoff is the maximum delay between reconnect attempts; defaults to 1 minute
+	ReconnectMaxBackoff time.Duration
+	// LinkQualityWindow is the period over which link rates and duty cycles are calculated;
+	// defaults to 1 minute
+	LinkQualityWindow time.Duration
+	// DegradedTimeout is how long the VARA modem program may be silent before its health is
+	// reported as degraded, ahead of AliveTimeout; defaults to 90 seconds
+	DegradedTimeout time.Duration
+	// ProbeInterval is how often the round-trip time of the command port is probed; zero disables
+	// probing
+	ProbeInterval time.Duration
+	// StallThreshold is how long buffered data must go unacknowledged before the link is considered
+	// stalled; defaults to 20 seconds
+	StallThreshold time.Duration
 }
 
 var defaultConfig = ModemConfig{
 	Host:     "localhost",
 	CmdPort:  8300,
 	DataPort: 8301,
+	Timing: Timing{
+		CmdWriteTimeout:     5 * time.Second,
+		AliveTimeout:        2 * time.Minute,
+		BufferTimeout:       time.Minute,
+		DisconnectTimeout:   60 * time.Second,
+		WriteSettleTime:     2 * time.Second,
+		LateDataWindow:      2 * time.Second,
+		BusyPollInterval:    300 * time.Millisecond,
+		ReconnectBackoff:    time.Second,
+		ReconnectMaxBackoff: time.Minute,
+		LinkQualityWindow:   time.Minute,
+		StallThreshold:      20 * time.Second,
+		DegradedTimeout:     90 * time.Second,
+	},
+	Clock:  systemClock{},
+	Logger: stdLogger{},
 }
 
 type Modem struct {
-	scheme         string
-	myCall         string
-	config         ModemConfig
-	bandwidth      string
-	cmdConn        *net.TCPConn
-	dataConn       *net.TCPConn
-	busy           bool
-	busyFunc       BusyFunc
-	cmds           pubSub
-	inboundConns   chan *conn
-	connectedState connectedState
-	rig            transport.PTTController
+	scheme       string
+	myCall       string
+	config       ModemConfig
+	logger       Logger
+	connMu       sync.Mutex
+	cmdConn      net.Conn      // nil while the TNC is unavailable
+	dataConn     net.Conn      // nil while the TNC is unavailable
+	tncReady     chan struct{} // Closed while the TNC is available
+	proc         *process      // nil unless ModemConfig.Process is set
+	capture      *capture      // nil unless ModemConfig.Capture is set
+	health       health
+	probeMu      sync.Mutex // Serializes VERSION queries, including probes
+	busyFunc     BusyFunc
+	cmds         pubSub
+	inboundConns chan *conn
+	rig          transport.PTTController
 
 	bufferCount *bufferCount
 	closeOnce   sync.Once
-	closed      bool
+	closed      int32         // Set to 1 when the modem is closed; accessed atomically
+	done        chan struct{} // Closed when the modem is closed
+
+	statusMu       sync.Mutex // Guards the fields below
+	connectedState connectedState
+	bandwidth      string // Default bandwidth, if set
+	activeListener *listener
+	busy           bool
+	ptt            bool
+	registered     string // Callsign VARA is registered to, if reported
+	version        string // Version of the VARA modem program, if reported
+
+	eventsMu     sync.Mutex // Guards the fields below
+	eventSubs    map[chan Event]struct{}
+	eventsClosed bool
+
+	sessionMu  sync.Mutex
+	session    *session // The current (or last) session
+	sessionSeq uint64
+	early      []byte // Data received before the next session's CONNECTED was handled
 }
 
 type connectedState int
@@ -71,6 +188,8 @@ func Bandwidths() []string {
 }
 
 // NewModem initializes configuration for a new VARA modem client stub.
+//
+// Unless config.DeferStart is set, the VARA modem program must be running.
 func NewModem(scheme string, myCall string, config ModemConfig) (*Modem, error) {
 	// Back-fill empty config values with defaults
 	if err := mergo.Merge(&config, defaultConfig); err != nil {
@@ -80,18 +199,43 @@ func NewModem(scheme string, myCall string, config ModemConfig) (*Modem, error)
 		scheme:         scheme,
 		myCall:         myCall,
 		config:         config,
+		logger:         withFields(config.Logger, "modem", scheme),
 		busy:           false,
 		cmds:           newPubSub(),
 		inboundConns:   make(chan *conn),
 		connectedState: disconnected,
 		bufferCount:    newBufferCount(),
+		done:           make(chan struct{}),
+		tncReady:       make(chan struct{}),
+	}
+	if config.Capture != nil {
+		c, err := newCapture(*config.Capture, scheme, myCall)
+		if err != nil {
+			return nil, err
+		}
+		m.capture = c
+	}
+	if config.Process != nil {
+		m.config.Reconnect = true
+		m.proc = newProcess(*config.Process, m.logger, func(error) { m.restartTNC("program exited") })
+	}
+	if config.DeferStart {
+		go m.reconnect()
+		return m, nil
 	}
 	if err := m.start(); err != nil {
+		if m.proc != nil {
+			m.proc.stop()
+		}
+		m.capture.close()
 		return nil, err
 	}
 	return m, nil
 }
 
+// isClosed returns true if the modem is closed.
+func (m *Modem) isClosed() bool { return atomic.LoadInt32(&m.closed) != 0 }
+
 // BusyFunc is a function that is called when the dialed channel is busy.
 //
 // If the channel is busy, the dialer blocks on this function call until it returns.
@@ -102,22 +246,64 @@ type BusyFunc func(context.Context) (abort bool)
 // SetBusyFunc sets the function that will be called if the channel is busy when dialing.
 func (m *Modem) SetBusyFunc(fn BusyFunc) { m.busyFunc = fn }
 
-// Start establishes TCP connections with the VARA modem program. This must be called before
-// sending commands to the modem.
+// Start establishes TCP connections with the VARA modem program and initializes it. This must be
+// called before sending commands to the modem.
 func (m *Modem) start() error {
+	// Launch the VARA modem program if we're supervising it
+	if m.proc != nil {
+		if err := m.proc.launch(); err != nil {
+			return err
+		}
+		if err := m.waitPorts(); err != nil {
+			m.proc.stop()
+			return err
+		}
+	}
+
 	// Open command port TCP connection
-	var err error
-	m.cmdConn, err = m.connectTCP("command", m.config.CmdPort)
+	cmdConn, err := m.connectTCP("command", m.config.CmdPort)
 	if err != nil {
 		return err
 	}
 
 	// Open the data port TCP connection
-	m.dataConn, err = m.connectTCP("data", m.config.DataPort)
+	dataConn, err := m.connectTCP("data", m.config.DataPort)
 	if err != nil {
+		cmdConn.Close()
+		return err
+	}
+
+	m.connMu.Lock()
+	if m.isClosed() {
+		m.connMu.Unlock()
+		cmdConn.Close()
+		dataConn.Close()
+		return ErrModemClosed
+	}
+	m.cmdConn, m.dataConn = cmdConn, dataConn
+	m.connMu.Unlock()
+
+	if err := m.initTNC(); err != nil {
+		m.closeConns()
 		return err
 	}
+	m.connMu.Lock()
+	ready := m.tncReady
+	close(ready)
+	m.connMu.Unlock()
+	m.health.connected(m.config.Clock.Now())
+	if m.config.Timing.ProbeInterval > 0 {
+		go m.probeLoop(ready)
+	}
 
+	// Start listening for incoming VARA commands and data
+	go m.cmdListen(cmdConn)
+	go m.dataListen(cmdConn, dataConn)
+	return nil
+}
+
+// initTNC applies the modem's state to a freshly connected VARA modem.
+func (m *Modem) initTNC() error {
 	// Select public
 	if err := m.writeCmd("PUBLIC ON"); err != nil {
 		return err
@@ -136,14 +322,19 @@ func (m *Modem) start() error {
 	if err := m.writeCmd(fmt.Sprintf("MYCALL %s", m.myCall)); err != nil {
 		return err
 	}
-	// Listen off
-	if err := m.writeCmd("LISTEN OFF"); err != nil {
+	// Query the version, reported by Status
+	if err := m.writeCmd("VERSION"); err != nil {
 		return err
 	}
-
-	// Start listening for incoming VARA commands
-	go m.cmdListen()
-	return nil
+	// Restore bandwidth (if set)
+	if err := m.setBandwidth(m.defaultBandwidth()); err != nil {
+		return err
+	}
+	// Listen on if we have an active listener (reconnect), off otherwise
+	if m.currentListener() != nil {
+		return m.writeCmd("LISTEN ON")
+	}
+	return m.writeCmd("LISTEN OFF")
 }
 
 // SetBandwidth sets the default bandwidth for outbound and inbound connections.
@@ -152,106 +343,157 @@ func (m *Modem) SetBandwidth(bandwidth string) error {
 		return err
 	}
 	// Save this so we can revert on disconnect in case it's changed via connect uri parameter
-	m.bandwidth = bandwidth
+	m.setStatus(func() { m.bandwidth = bandwidth })
 	return nil
 }
 
 // Idle returns true if the modem is not in a connecting or connected state.
 func (m *Modem) Idle() bool {
-	return m.connectedState == disconnected
+	return m.state() == disconnected
 }
 
 // Close closes the RF and then the TCP connections to the VARA modem. Blocks until finished.
-func (m *Modem) Close() error {
+func (m *Modem) Close() error { return m.CloseContext(context.Background()) }
+
+// CloseContext is like Close, but aborts any active link if the context is cancelled before it is
+// gracefully disconnected. The TCP connections are closed regardless.
+func (m *Modem) CloseContext(ctx context.Context) error {
+	var err error
 	m.closeOnce.Do(func() {
-		m.closed = true
+		atomic.StoreInt32(&m.closed, 1)
 		defer func() {
+			close(m.done)
 			m.cmds.Close()
+			m.closeEvents()
 			close(m.inboundConns)
-			m.dataConn.Close()
-			m.cmdConn.Close()
+			m.closeConns()
+			if m.proc != nil {
+				m.proc.stop()
+			}
+			m.capture.close()
 		}()
 
 		// Disconnect if connected
 		connectChange, cancel := m.cmds.Subscribe("DISCONNECTED", "CONNECTED")
 		defer cancel()
-		if m.connectedState != disconnected {
+		if m.state() != disconnected {
 			// Send DISCONNECT command
+			m.setEndReason(EndGraceful)
 			if err := m.writeCmd("DISCONNECT"); err != nil {
 				// We have already lost connection with the modem, just publish that the state is disconnected and return.
 				m.cmds.Publish("DISCONNECTED")
 				m.handleDisconnected()
+				m.publishEvent("DISCONNECTED")
 				return
 			}
+			timeout, stop := m.after(m.config.Timing.DisconnectTimeout)
+			defer stop()
 			select {
 			case res := <-connectChange:
 				if res != "DISCONNECTED" {
-					log.Println("Disconnect failed, aborting!")
+					m.logger.Warn("Disconnect failed, aborting!")
 					m.Abort()
 				}
-			case <-time.After(time.Second * 60):
+			case <-timeout:
+				m.setEndReason(EndTimeout)
 				m.Abort()
+			case <-ctx.Done():
+				m.Abort()
+				err = ctx.Err()
 			}
 		}
 
 		// Make sure to stop TX (should have already happened, but this is a backup)
 		m.sendPTT(false)
 	})
-	return nil
+	return err
 }
 
-func (m *Modem) connectTCP(name string, port int) (*net.TCPConn, error) {
-	debugPrint("Connecting %s", name)
-	cmdAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", m.config.Host, port))
-	if err != nil {
-		return nil, fmt.Errorf("couldn't resolve VARA %s address: %w", name, err)
-	}
-	conn, err := net.DialTCP("tcp", nil, cmdAddr)
-	if err != nil {
+func (m *Modem) connectTCP(name string, port int) (net.Conn, error) {
+	m.logger.Debug("Connecting", "port", name)
+	// A hanging dial (e.g. through a proxy) must not block Close.
+	ctx, cancel := m.doneContext()
+	defer cancel()
+	conn, err := m.dial(ctx, port)
+	switch {
+	case err != nil && m.isClosed():
+		return nil, ErrModemClosed
+	case err != nil:
 		return nil, fmt.Errorf("couldn't connect to VARA %s port: %w", name, err)
 	}
 	return conn, nil
 }
 
-func disconnectTCP(name string, port *net.TCPConn) *net.TCPConn {
+// doneContext returns a context that is cancelled when the modem is closed.
+func (m *Modem) doneContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (m *Modem) disconnectTCP(name string, port net.Conn) net.Conn {
 	if port == nil {
 		return nil
 	}
 	_ = port.Close()
-	debugPrint("disonnected %s", name)
+	m.logger.Debug("Disconnected", "port", name)
 	return nil
 }
 
 // wrapper around m.cmdConn.Write
 func (m *Modem) writeCmd(cmd string) error {
-	debugPrint3("writing cmd: %v", cmd)
-	if m.closed {
+	m.logger.Debug("Writing command", "command", cmd)
+	if m.isClosed() {
 		return ErrModemClosed
 	}
-	m.cmdConn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	if m.cmdConn == nil {
+		return ErrTNCUnavailable
+	}
+	m.cmdConn.SetWriteDeadline(time.Now().Add(m.config.Timing.CmdWriteTimeout))
 	_, err := m.cmdConn.Write([]byte(cmd + "\r"))
-	if err != nil {
-		m.closed = true
-		debugPrint3("writeCmd err: %v", err)
+	if err == nil {
+		m.captureRecord(CaptureCmdOut, []byte(cmd))
+	} else {
+		m.logger.Debug("Writing command failed", "command", cmd, "error", err)
+		if m.config.Reconnect {
+			// Make sure cmdListen fails, triggering a reconnect.
+			m.cmdConn.Close()
+		} else {
+			atomic.StoreInt32(&m.closed, 1)
+		}
 	}
 	return err
 }
 
 // goroutine listening for incoming commands
-func (m *Modem) cmdListen() {
-	defer m.Close()
+func (m *Modem) cmdListen(cmdConn net.Conn) {
+	// VARA spec says it sends IAMALIVE every 60 seconds, so if we have not heard anything
+	// for a while (AliveTimeout), assume we have lost connection with the modem.
+	watchdog := m.config.Clock.AfterFunc(m.config.Timing.AliveTimeout, func() {
+		m.logger.Debug("Alive timeout", "timeout", m.config.Timing.AliveTimeout)
+		cmdConn.Close()
+	})
+	defer watchdog.Stop()
+
 	buf := make([]byte, 1<<16)
-	for !m.closed {
-		// VARA spec says it sends IAMALIVE every 60 seconds, so if we have not heard anything
-		// for 2 minutes, assume we have lost connection and close the modem.
-		m.cmdConn.SetReadDeadline(time.Now().Add(2 * time.Minute))
-		l, err := m.cmdConn.Read(buf)
+	for !m.isClosed() {
+		l, err := cmdConn.Read(buf)
+		watchdog.Reset(m.config.Timing.AliveTimeout)
 		if err != nil {
-			if m.connectedState != disconnected {
-				log.Println("VARA modem disconnected unexpectedly!")
+			if m.state() != disconnected {
+				m.logger.Error("VARA modem disconnected unexpectedly!")
 			}
-			debugPrint("cmdListen err: %v", err)
-			m.cmdConn.Close() // Make sure any attempts to write to the connection fails hard.
+			m.logger.Debug("Reading command failed", "error", err)
+			cmdConn.Close() // Make sure any attempts to write to the connection fails hard.
+			m.tncLost(err)
 			return
 		}
 		cmds := strings.Split(string(buf[:l]), "\r")
@@ -259,7 +501,10 @@ func (m *Modem) cmdListen() {
 			if c == "" {
 				continue
 			}
+			m.captureRecord(CaptureCmdIn, []byte(c))
+			m.health.received(c, m.config.Clock.Now())
 			m.handleCmd(c)
+			m.publishEvent(c)
 			m.cmds.Publish(c)
 		}
 	}
@@ -268,20 +513,30 @@ func (m *Modem) cmdListen() {
 // handleCmd handles one command coming from the VARA modem. It returns true if listening should
 // continue or false if listening should stop.
 func (m *Modem) handleCmd(c string) {
-	debugPrint("got cmd: %v", c)
+	m.logger.Debug("Got command", "command", c)
 	switch c {
 	case "PTT ON":
 		// VARA wants to start TX; send that to the PTTController
+		m.setStatus(func() { m.ptt = true })
 		m.sendPTT(true)
+		if s := m.activeSession(); s != nil {
+			s.quality.setPTT(true, m.config.Clock.Now())
+		}
 	case "PTT OFF":
 		// VARA wants to stop TX; send that to the PTTController
+		m.setStatus(func() { m.ptt = false })
 		m.sendPTT(false)
+		if s := m.activeSession(); s != nil {
+			s.quality.setPTT(false, m.config.Clock.Now())
+		}
 	case "BUSY ON":
-		m.busy = true
+		m.setStatus(func() { m.busy = true })
 	case "BUSY OFF":
-		m.busy = false
-	case "OK", "WRONG":
+		m.setStatus(func() { m.busy = false })
+	case "OK":
 		// nothing to do
+	case "WRONG":
+		m.health.protocolError("WRONG reply")
 	case "IAMALIVE":
 		// nothing to do
 	case "PENDING":
@@ -296,9 +551,17 @@ func (m *Modem) handleCmd(c string) {
 		// nothing to do
 	case "DISCONNECTED":
 		m.handleDisconnected()
+	case "MISSING SOUNDCARD":
+		m.logger.Error("VARA modem reports missing sound card")
+		m.restartTNC("missing sound card")
 	default:
 		if strings.HasPrefix(c, "BUFFER ") {
-			m.bufferCount.set(parseBuffer(c))
+			n := parseBuffer(c)
+			m.bufferCount.set(n)
+			if s := m.activeSession(); s != nil {
+				now := m.config.Clock.Now()
+				s.quality.buffer(n, s.progress.buffer(n, now), now)
+			}
 			break
 		}
 		if strings.HasPrefix(c, "CONNECTED ") {
@@ -308,14 +571,25 @@ func (m *Modem) handleCmd(c string) {
 		if strings.HasPrefix(c, "REGISTERED") {
 			parts := strings.Split(c, " ")
 			if len(parts) > 1 {
-				log.Printf("VARA full speed available, registered to %s", parts[1])
+				m.setStatus(func() { m.registered = parts[1] })
+				m.logger.Info("VARA full speed available", "registered", parts[1])
 			}
 			break
 		}
 		if strings.HasPrefix(c, "VERSION") {
+			m.setStatus(func() { m.version = strings.TrimPrefix(c, "VERSION ") })
+			break
+		}
+		if strings.HasPrefix(c, "SN ") {
+			if sn, ok := parseSN(c); ok {
+				if s := m.activeSession(); s != nil {
+					s.quality.setSN(sn)
+				}
+			}
 			break
 		}
-		debugPrint("got a vara command I wasn't expecting: %q", c)
+		m.logger.Debug("Got a command I wasn't expecting", "command", c)
+		m.health.protocolError(fmt.Sprintf("unexpected command %q", c))
 	}
 }
 
@@ -326,45 +600,88 @@ func (m *Modem) sendPTT(on bool) {
 }
 
 func (m *Modem) handleDisconnected() {
-	m.connectedState = disconnected
-	m.bufferCount.reset()       // reset buffer count in case we had outstanding frames
-	m.setBandwidth(m.bandwidth) // reset bandwidth to default in case it was changed
+	m.setStatus(func() { m.connectedState = disconnected })
+	m.endSession()
+
+	m.bufferCount.reset()                // reset buffer count in case we had outstanding frames
+	m.setBandwidth(m.defaultBandwidth()) // reset bandwidth to default in case it was changed
 }
 
 func (m *Modem) handleConnected(cmd string) {
-	m.connectedState = connected
+	m.setStatus(func() { m.connectedState = connected })
 	parts := strings.Split(cmd, " ")
 	if len(parts) < 3 {
 		panic(fmt.Sprintf("unexpected CONNECTED command: %q", cmd))
 	}
+
+	// The bandwidth is the last field, if present (VARA SAT omits it).
+	var bandwidth string
+	if len(parts) > 3 {
+		bandwidth = parts[len(parts)-1]
+	}
+
 	switch src, dst := parts[1], parts[2]; {
 	case src == m.myCall:
-		// Handled by DialURL through pubsub.
+		m.startSession(dst, bandwidth, false)
+		// The conn is handed out by DialURL through pubsub.
 	case dst == m.myCall:
-		select {
-		case m.inboundConns <- m.newConn(src):
-		default:
-			debugPrint("no one is calling Accept() at this time. dropping connection from %s", src)
+		m.startSession(src, bandwidth, true)
+		ln := m.currentListener()
+		if ln != nil && ln.admission != nil {
+			if err := ln.admission.admit(src, m.config.Clock.Now()); err != nil {
+				m.reject(ln.admission, src, err)
+				break
+			}
+		}
+		if ln == nil {
+			m.logger.Debug("Not listening, dropping inbound connection", "remote", src)
 			m.writeCmd("DISCONNECT")
+			break
 		}
+		conn := m.newConn(src)
+		conn.enforceLimits(m.defaultLimits())
+		ln.enqueue(conn)
 	default:
 		panic(fmt.Sprintf("unhandled CONNECTED cmd: %q", cmd))
 	}
 }
 
+// Ping returns true if the modem is open and connected to the VARA modem program.
 func (m *Modem) Ping() bool {
-	return !m.closed
+	m.connMu.Lock()
+	defer m.connMu.Unlock()
+	return !m.isClosed() && m.cmdConn != nil
 }
 
-func (m *Modem) Version() (string, error) {
+// Version returns the version reported by the VARA modem.
+func (m *Modem) Version() (string, error) { return m.VersionContext(context.Background()) }
+
+// VersionContext is like Version, but returns ctx.Err() if the context is cancelled before the
+// modem replies.
+func (m *Modem) VersionContext(ctx context.Context) (string, error) {
+	m.probeMu.Lock()
+	defer m.probeMu.Unlock()
+	return m.queryVersion(ctx, "version")
+}
+
+// queryVersion sends VERSION and waits for the reply. The caller must hold m.probeMu, as concurrent
+// queries can't tell the replies apart.
+func (m *Modem) queryVersion(ctx context.Context, op string) (string, error) {
 	resp, cancel := m.cmds.Subscribe("VERSION", "WRONG")
 	defer cancel()
 	if err := m.writeCmd("VERSION"); err != nil {
 		return "", err
 	}
-	str := <-resp
-	if str == "WRONG" {
-		return "", errors.New("VERSION not implemented")
+	select {
+	case str, ok := <-resp:
+		switch {
+		case !ok:
+			return "", ErrModemClosed
+		case str == "WRONG":
+			return "", &OpError{Op: op, Err: ErrRejected}
+		}
+		return strings.TrimPrefix(str, "VERSION "), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
 	}
-	return strings.TrimPrefix(str, "VERSION "), nil
 }
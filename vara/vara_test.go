@@ -1,25 +1,42 @@
 package vara
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/la5nta/wl2k-go/transport"
 )
 
 func TestInterfaces(t *testing.T) {
-	modem, _ := NewModem("varafm", "N0CALL", ModemConfig{})
-
 	// Ensure modem implements the necessary interfaces
 	// (https://github.com/la5nta/pat/wiki/Adding-transports)
-	var _ transport.Dialer = modem
+	var _ transport.Dialer = (*Modem)(nil)
 	var _ net.Conn = &conn{}
 
 	// Ensure modem implements optional interfaces with extended functionality
 	var _ net.Listener = &listener{}
-	var _ transport.BusyChannelChecker = modem
+	var _ transport.BusyChannelChecker = (*Modem)(nil)
 	var _ transport.Flusher = &conn{}
 	var _ transport.TxBuffer = &conn{}
+	var _ io.ReaderFrom = &conn{}
+	var _ io.WriterTo = &conn{}
+
+	// Ensure context-aware variants are available
+	var _ interface {
+		AcceptContext(context.Context) (net.Conn, error)
+	} = &listener{}
+	var _ interface {
+		FlushContext(context.Context) error
+		CloseContext(context.Context) error
+		CloseWrite() error
+	} = &conn{}
 }
 
 func TestBandwidths(t *testing.T) {
@@ -28,3 +45,414 @@ func TestBandwidths(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestURLLimits(t *testing.T) {
+	m := &Modem{config: ModemConfig{IdleTimeout: time.Minute, MaxSessionDuration: time.Hour}}
+	tests := []struct {
+		url     string
+		want    sessionLimits
+		wantErr bool
+	}{
+		{"varahf:///LA5NTA", sessionLimits{idle: time.Minute, duration: time.Hour}, false},
+		{"varahf:///LA5NTA?idle_timeout=5m", sessionLimits{idle: 5 * time.Minute, duration: time.Hour}, false},
+		{"varahf:///LA5NTA?idle_timeout=0&max_duration=2h", sessionLimits{duration: 2 * time.Hour}, false},
+		{"varahf:///LA5NTA?max_duration=forever", sessionLimits{}, true},
+	}
+	for _, tt := range tests {
+		url, err := transport.ParseURL(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.urlLimits(url)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("%s: expected error", tt.url)
+		case !tt.wantErr && (err != nil || got != tt.want):
+			t.Errorf("%s: got %+v, %v, want %+v", tt.url, got, err, tt.want)
+		}
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	tests := map[string]int{
+		"500":  512,
+		"2300": 2048,
+		"WIDE": 8192,
+		"":     2048, // Unknown
+	}
+	for bw, want := range tests {
+		v := &conn{session: &session{bandwidth: bw}}
+		if got := v.chunkSize(); got != want {
+			t.Errorf("chunkSize(%q) = %d, want %d", bw, got, want)
+		}
+	}
+}
+
+func TestRxBuffer(t *testing.T) {
+	rx := newRxBuffer()
+	rx.setDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := rx.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	rx.setDeadline(time.Time{})
+
+	rx.write([]byte("foo"))
+	rx.closeWithError(io.EOF)
+	if rx.write([]byte("bar")) {
+		t.Fatal("write to closed buffer succeeded")
+	}
+	b, err := io.ReadAll(rx)
+	if err != nil || string(b) != "foo" {
+		t.Fatalf("unexpected read: %q (%v)", b, err)
+	}
+}
+
+func TestOpError(t *testing.T) {
+	var err error = &OpError{Op: "dial", Target: "N0CALL", Elapsed: time.Minute, Err: ErrConnectTimeout}
+	if !errors.Is(err, ErrConnectTimeout) {
+		t.Error("expected error to match ErrConnectTimeout")
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("expected a net.Error timeout")
+	}
+	if got, want := err.Error(), "dial N0CALL: connect timeout (after 1m0s)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var p progress
+	var acks []Progress
+	p.setAckFunc(func(pr Progress) { acks = append(acks, pr) })
+
+	start := time.Now()
+	p.wrote(100, start)
+	p.buffer(60, start)                     // Data added to the TX buffer
+	p.buffer(100, start)                    // Data added to the TX buffer
+	p.buffer(50, start.Add(10*time.Second)) // 50 bytes acked
+	p.buffer(0, start.Add(20*time.Second))  // 50 bytes acked
+	p.buffer(0, start.Add(30*time.Second))  // No change
+	if len(acks) != 2 {
+		t.Fatalf("expected 2 acks, got %d", len(acks))
+	}
+	if got := acks[0]; got.Acked != 50 || got.Buffered != 50 || got.TimeToDrain != 10*time.Second {
+		t.Errorf("unexpected progress: %+v", got)
+	}
+	if got := acks[1]; got.Written != 100 || got.Acked != 100 || got.TimeToDrain != 0 {
+		t.Errorf("unexpected progress: %+v", got)
+	}
+}
+
+func TestLinkQuality(t *testing.T) {
+	start := time.Now()
+	q := newLinkQuality(Timing{LinkQualityWindow: time.Minute, StallThreshold: 20 * time.Second}, start)
+
+	q.setPTT(true, start)
+	q.buffer(1000, 0, start)
+	q.setPTT(false, start.Add(10*time.Second))
+	q.received(200, start.Add(15*time.Second))
+	q.buffer(0, 1000, start.Add(30*time.Second)) // Acked after a 30s stall
+
+	lq := q.snapshot(start.Add(40 * time.Second))
+	if lq.Window != 40*time.Second {
+		t.Errorf("unexpected window: %v", lq.Window)
+	}
+	if lq.TxRate != 25 || lq.RxRate != 5 {
+		t.Errorf("unexpected rates: tx %v, rx %v", lq.TxRate, lq.RxRate)
+	}
+	if lq.TxDuty != 0.25 || lq.RxDuty != 0.75 {
+		t.Errorf("unexpected duty: tx %v, rx %v", lq.TxDuty, lq.RxDuty)
+	}
+	if lq.Stalls != 1 || lq.StallTime != 30*time.Second || lq.Stalled {
+		t.Errorf("unexpected stalls: %+v", lq)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(AdmissionPolicy{
+		Allow:      []string{"LA5NTA-*", "N0CALL"},
+		Deny:       []string{"LA5NTA-10"},
+		RateLimit:  1,
+		RatePeriod: time.Minute,
+	})
+	now := time.Now()
+	tests := []struct {
+		call    string
+		allowed bool
+	}{
+		{"la5nta", true},
+		{"LA5NTA-1", true},
+		{"LA5NTA-10", false},
+		{"N0CALL", true},
+		{"N0CALL-1", false},
+		{"N0CALL", false}, // Rate limited
+	}
+	for _, tt := range tests {
+		if err := a.admit(tt.call, now); (err == nil) != tt.allowed {
+			t.Errorf("%s: unexpected admission result: %v", tt.call, err)
+		} else if err != nil && !errors.Is(err, ErrRejected) {
+			t.Errorf("%s: expected ErrRejected, got %v", tt.call, err)
+		}
+	}
+	if err := a.admit("N0CALL", now.Add(time.Minute)); err != nil {
+		t.Errorf("unexpected rate limit after period: %v", err)
+	}
+
+	// Func may call back into the admission, e.g. by the modem handling another caller.
+	var b *admission
+	b = newAdmission(AdmissionPolicy{
+		RateLimit:  1,
+		RatePeriod: time.Minute,
+		Func: func(call string) error {
+			if call == "N0CALL" {
+				return b.admit("LA5NTA", now)
+			}
+			return nil
+		},
+	})
+	admitted := make(chan error, 1)
+	go func() { admitted <- b.admit("N0CALL", now) }()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("unexpected rejection: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("admission deadlocked calling Func")
+	}
+
+	_, err := ListenConfig{Admission: &AdmissionPolicy{RateLimit: 1}}.Listen(&Modem{})
+	if err == nil {
+		t.Error("expected Listen to fail with a RateLimit but no RatePeriod")
+	}
+}
+
+func TestDeferStart(t *testing.T) {
+	// Grab a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	newModem := func(waitForTNC bool) *Modem {
+		config := ModemConfig{Host: "127.0.0.1", CmdPort: port, DataPort: port, DeferStart: true, WaitForTNC: waitForTNC}
+		m, err := NewModem("varafm", "N0CALL", config)
+		if err != nil {
+			t.Fatalf("NewModem: %v", err)
+		}
+		t.Cleanup(func() { m.Close() })
+		return m
+	}
+	url := &transport.URL{Scheme: "varafm", Target: "LA5NTA"}
+
+	m := newModem(false)
+	if m.Ping() {
+		t.Error("expected Ping to fail while the TNC is unavailable")
+	}
+	if _, err := m.DialURL(url); !errors.Is(err, ErrTNCUnavailable) {
+		t.Errorf("expected ErrTNCUnavailable, got %v", err)
+	}
+
+	m = newModem(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialURLContext(ctx, url); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	ln, err := m.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	ln.Close()
+}
+
+func TestCloseCancelsDial(t *testing.T) {
+	dialing, cancelled := make(chan struct{}, 1), make(chan struct{})
+	hang := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialing <- struct{}{}
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	}
+	m, err := NewModem("varafm", "N0CALL", ModemConfig{DeferStart: true, DialContext: hang})
+	if err != nil {
+		t.Fatalf("NewModem: %v", err)
+	}
+	<-dialing
+	m.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("dial not cancelled by Close")
+	}
+}
+
+func TestINI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Wine prefix is not used on Windows")
+	}
+	const ini = "[Setup]\r\n" +
+		"Callsign Licence 0=la5nta\r\n" +
+		"Callsign Licence 1=\r\n" +
+		"TCP Command Port=8500\r\n" +
+		"[Monitor]\r\n" +
+		"Monitor Mode=0\r\n"
+
+	prefix := t.TempDir()
+	dir := filepath.Join(prefix, "drive_c", "VARA FM")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "VARAFM.ini"), []byte(ini), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("WINEPREFIX", os.Getenv("WINEPREFIX"))
+	os.Setenv("WINEPREFIX", prefix)
+
+	s, err := LoadINI("varafm")
+	if err != nil {
+		t.Fatalf("LoadINI: %v", err)
+	}
+	if s.CmdPort != 8500 || s.DataPort != 8501 {
+		t.Errorf("unexpected ports: %d/%d", s.CmdPort, s.DataPort)
+	}
+	if !s.Registered("LA5NTA-1") || s.Registered("N0CALL") {
+		t.Errorf("unexpected callsigns: %v", s.Callsigns)
+	}
+	if _, err := LoadINI("varahf"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+
+	config := ModemConfig{DataPort: 8301}
+	if mismatches := s.Apply(&config, "LA5NTA-1"); len(mismatches) != 1 {
+		t.Errorf("expected a data port mismatch, got %v", mismatches)
+	}
+	if config.CmdPort != 8500 {
+		t.Errorf("expected command port to be filled, got %d", config.CmdPort)
+	}
+	if mismatches := s.Apply(&config, "N0CALL"); len(mismatches) != 2 {
+		t.Errorf("expected a data port and callsign mismatch, got %v", mismatches)
+	}
+	if mismatches := (&INISettings{}).Apply(&config, "N0CALL"); len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches for unregistered VARA: %v", mismatches)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var h health
+	start := time.Now()
+	if s := h.snapshot(90*time.Second, start); s.Connected || s.Degraded {
+		t.Errorf("unexpected health before connecting: %+v", s)
+	}
+
+	h.connected(start)
+	h.received("IAMALIVE", start.Add(60*time.Second))
+	h.received("WRONG", start.Add(61*time.Second))
+	h.protocolError("WRONG reply")
+	h.probed(20*time.Millisecond, nil, start.Add(62*time.Second))
+	s := h.snapshot(90*time.Second, start.Add(120*time.Second))
+	switch {
+	case !s.Connected, s.Degraded:
+		t.Errorf("expected healthy connection: %+v", s)
+	case s.Uptime != 2*time.Minute:
+		t.Errorf("unexpected uptime: %s", s.Uptime)
+	case !s.LastAlive.Equal(start.Add(60 * time.Second)):
+		t.Errorf("unexpected last IAMALIVE: %s", s.LastAlive)
+	case s.RTT != 20*time.Millisecond, s.ProtocolErrors != 1:
+		t.Errorf("unexpected RTT or protocol errors: %+v", s)
+	}
+
+	if s := h.snapshot(90*time.Second, start.Add(152*time.Second)); !s.Degraded {
+		t.Errorf("expected degraded health after being silent: %+v", s)
+	}
+	h.probed(0, context.DeadlineExceeded, start.Add(125*time.Second))
+	if s := h.snapshot(90*time.Second, start.Add(125*time.Second)); !s.Degraded || s.RTT != 20*time.Millisecond {
+		t.Errorf("expected degraded health after failed probe: %+v", s)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	m := &Modem{
+		config:         defaultConfig,
+		logger:         defaultConfig.Logger,
+		cmds:           newPubSub(),
+		connectedState: disconnected,
+		bufferCount:    newBufferCount(),
+	}
+	defer m.cmds.Close()
+	events, cancel := m.Events()
+	defer cancel()
+
+	for _, c := range []string{"BUSY ON", "IAMALIVE", "REGISTERED N0CALL"} {
+		m.handleCmd(c)
+		m.publishEvent(c)
+	}
+	e := <-events
+	if e.Type != EventBusy || !e.Status.Busy {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	e = <-events
+	if e.Type != EventRegistered || e.Status.Registered != "N0CALL" {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if s := m.Status(); s.State != StateDisconnected || s.TNCAvailable {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	// Each event carries the state right after its change, even when received later.
+	for _, c := range []string{"PTT ON", "PTT OFF", "PTT ON", "BUFFER 42", "PTT OFF", "BUFFER 0"} {
+		m.handleCmd(c)
+		m.publishEvent(c)
+	}
+	for _, want := range []Event{
+		{Type: EventPTT, Status: Status{PTT: true}},
+		{Type: EventPTT, Status: Status{PTT: false}},
+		{Type: EventPTT, Status: Status{PTT: true}},
+		{Type: EventBuffer, Status: Status{PTT: true, TxBuffer: 42}},
+		{Type: EventPTT, Status: Status{PTT: false, TxBuffer: 42}},
+		{Type: EventBuffer, Status: Status{PTT: false, TxBuffer: 0}},
+	} {
+		e := <-events
+		if e.Type != want.Type || e.Status.PTT != want.Status.PTT || e.Status.TxBuffer != want.Status.TxBuffer {
+			t.Errorf("unexpected event %v: %+v, expected %+v", e.Type, e.Status, want.Status)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+type recordingLogger struct{ lines []string }
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("DEBUG", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("INFO", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("WARN", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("ERROR", msg, args) }
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	l.lines = append(l.lines, level+" "+formatLog(msg, args))
+}
+
+func TestLogger(t *testing.T) {
+	var rec recordingLogger
+	modem := withFields(&rec, "modem", "varahf")
+	session := withFields(modem, "remote", "LA5NTA", "session", 1)
+	session.Info("Session limit exceeded", "error", ErrIdleTimeout)
+	modem.Debug("Got command", "command", "PTT ON", "odd")
+
+	want := []string{
+		`INFO Session limit exceeded modem=varahf remote=LA5NTA session=1 error="idle timeout"`,
+		`DEBUG Got command modem=varahf command="PTT ON" !BADKEY=odd`,
+	}
+	if len(rec.lines) != len(want) {
+		t.Fatalf("unexpected lines: %q", rec.lines)
+	}
+	for i := range want {
+		if rec.lines[i] != want[i] {
+			t.Errorf("got %q, want %q", rec.lines[i], want[i])
+		}
+	}
+}
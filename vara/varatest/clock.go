@@ -0,0 +1,148 @@
+package varatest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+// Clock is a manually advanced vara.Clock, for testing the modem's timeouts deterministically.
+//
+// Time only passes when Advance is called. Tests should wait for the timer under test to be armed
+// (WaitTimer) before advancing the clock past it.
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*timer
+	changed chan struct{} // Closed (and replaced) when a timer is armed
+}
+
+// NewClock returns a Clock starting at now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, changed: make(chan struct{})}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a timer sending the current time on its channel once the clock is advanced by d.
+func (c *Clock) NewTimer(d time.Duration) vara.Timer {
+	t := &timer{clock: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc returns a timer calling f in its own goroutine once the clock is advanced by d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) vara.Timer {
+	t := &timer{clock: c, fn: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing all timers due in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		t.active = false
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		t.fire(c.now)
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// WaitTimer blocks until a timer firing d from now is pending, e.g. a timer just armed with d.
+func (c *Clock) WaitTimer(ctx context.Context, d time.Duration) error {
+	for {
+		c.mu.Lock()
+		for _, t := range c.timers {
+			if t.when.Equal(c.now.Add(d)) {
+				c.mu.Unlock()
+				return nil
+			}
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// remove removes t from the pending timers. The caller must hold c.mu.
+func (c *Clock) remove(t *timer) {
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return
+		}
+	}
+}
+
+type timer struct {
+	clock *Clock
+	ch    chan time.Time
+	fn    func()
+
+	// Guarded by clock.mu
+	when   time.Time
+	active bool
+}
+
+func (t *timer) C() <-chan time.Time { return t.ch }
+
+func (t *timer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	t.clock.remove(t)
+	return wasActive
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasActive := t.active
+	c.remove(t)
+	t.when, t.active = c.now.Add(d), d > 0
+	if t.active {
+		c.timers = append(c.timers, t)
+	} else {
+		t.fire(c.now) // Like time.Timer, fire immediately
+	}
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return wasActive
+}
+
+// fire delivers the timer. The caller must hold clock.mu.
+func (t *timer) fire(now time.Time) {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
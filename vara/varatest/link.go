@@ -0,0 +1,412 @@
+package varatest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// defaultThroughput is the net throughput in bytes per second of each VARA bandwidth, at the
+// highest speed level.
+var defaultThroughput = map[string]int{
+	"500":    1608 / 8,
+	"2300":   7536 / 8,
+	"2750":   8489 / 8,
+	"NARROW": 12750 / 8,
+	"WIDE":   25210 / 8,
+}
+
+// LinkOptions configures a Link.
+type LinkOptions struct {
+	// Bandwidth is the initial bandwidth of both stations; defaults to "2300"
+	Bandwidth string
+	// Throughput overrides the throughput in bytes per second of the given bandwidths. The
+	// defaults are the net throughput of VARA at the highest speed level.
+	Throughput map[string]int
+	// Latency is the one way delay of each frame, including processing by VARA
+	Latency time.Duration
+	// Turnaround is the delay whenever the channel changes direction
+	Turnaround time.Duration
+	// FrameSize is the maximum number of bytes sent per frame; defaults to 512
+	FrameSize int
+	// Loss is the probability of a frame being lost and retransmitted
+	Loss float64
+	// MaxRetries is the number of consecutive lost frames before the link fails; defaults to 10
+	MaxRetries int
+	// BufferInterval is the minimum time between BUFFER reports while sending; zero reports after
+	// each frame. A BUFFER report is always sent when data is written and when all data is sent.
+	BufferInterval time.Duration
+	// ConnectTimeout is how long a connection to a station that doesn't answer is attempted;
+	// defaults to 10 seconds
+	ConnectTimeout time.Duration
+	// Seed seeds the random frame loss
+	Seed int64
+}
+
+// Link simulates a radio channel between two VARA stations, each a fake TNC.
+//
+// A modem connected to A can dial the callsign of a listening modem connected to B (or the other
+// way around), and exchange data through the simulated channel: the link is half duplex, sending
+// frames of at most FrameSize bytes at the throughput of the bandwidth chosen by the calling
+// station. Both stations see the BUFFER and PTT commands VARA would send, and the channel can be
+// made busy (SetBusy) or the link lost (Fail) at any time. No frames are sent while the channel is
+// busy.
+type Link struct {
+	A, B *TNC
+
+	opts LinkOptions
+	rand *rand.Rand
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	deliveries [2]chan delivery
+
+	mu         sync.Mutex
+	state      string // "", "connecting", "connected" or "disconnecting"
+	session    int    // Incremented when a connection starts or ends, cancelling pending work
+	bandwidth  string
+	caller     int // Index of the calling station
+	closer     int // Index of the station disconnecting
+	busy       bool
+	queue      [2][]byte
+	lastBuffer [2]time.Time
+	retries    int
+}
+
+// delivery is an event reaching a station at a given time.
+type delivery struct {
+	at time.Time
+	fn func()
+}
+
+// NewLink starts a link between two fake TNCs.
+func NewLink(opts LinkOptions) (*Link, error) {
+	if opts.Bandwidth == "" {
+		opts.Bandwidth = "2300"
+	}
+	if opts.FrameSize == 0 {
+		opts.FrameSize = 512
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 10
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = 10 * time.Second
+	}
+	l := &Link{
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Seed)),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	var err error
+	if l.A, err = newTNC(TNCOptions{Bandwidth: opts.Bandwidth}, l); err != nil {
+		return nil, err
+	}
+	if l.B, err = newTNC(TNCOptions{Bandwidth: opts.Bandwidth}, l); err != nil {
+		l.A.Close()
+		return nil, err
+	}
+	for i := range l.deliveries {
+		l.deliveries[i] = make(chan delivery, 1024)
+		go l.deliver(l.deliveries[i])
+	}
+	go l.run()
+	return l, nil
+}
+
+// Close stops the link and both TNCs.
+func (l *Link) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.A.Close()
+		l.B.Close()
+	})
+	return nil
+}
+
+// SetBusy simulates a third station occupying the channel, detected as busy by both stations.
+// Transmission of queued data is deferred until the channel is clear.
+func (l *Link) SetBusy(busy bool) error {
+	l.mu.Lock()
+	l.busy = busy
+	l.mu.Unlock()
+	l.wakeup()
+	errA, errB := l.A.SetBusy(busy), l.B.SetBusy(busy)
+	if errA != nil {
+		return errA
+	}
+	return errB
+}
+
+// Fail simulates losing the link mid-session: both stations disconnect immediately and data not
+// yet delivered is lost.
+func (l *Link) Fail() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail()
+}
+
+// fail ends the connection. The caller must hold l.mu.
+func (l *Link) fail() {
+	switch l.state {
+	case "connecting":
+		l.end()
+		t := l.station(l.caller)
+		l.schedule(l.caller, 0, func() { t.linkEvent("DISCONNECTED", "", "") })
+	case "connected", "disconnecting":
+		l.end()
+		for i := range l.deliveries {
+			t := l.station(i)
+			l.schedule(i, 0, func() { t.linkEvent("DISCONNECTED", "", "") })
+		}
+	}
+}
+
+// end resets the link state and cancels pending work. The caller must hold l.mu.
+func (l *Link) end() {
+	l.state = ""
+	l.session++
+	l.queue = [2][]byte{}
+	l.retries = 0
+}
+
+func (l *Link) station(i int) *TNC {
+	if i == 0 {
+		return l.A
+	}
+	return l.B
+}
+
+func (l *Link) index(t *TNC) int {
+	if t == l.A {
+		return 0
+	}
+	return 1
+}
+
+// schedule delivers fn to station i after delay, in order with all events for that station.
+// The caller must hold l.mu.
+func (l *Link) schedule(i int, delay time.Duration, fn func()) {
+	select {
+	case l.deliveries[i] <- delivery{time.Now().Add(delay), fn}:
+	case <-l.done:
+	}
+}
+
+func (l *Link) deliver(deliveries chan delivery) {
+	for {
+		select {
+		case d := <-deliveries:
+			if !l.sleep(time.Until(d.at)) {
+				return
+			}
+			d.fn()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// sleep waits for d, returning false if the link is closed meanwhile.
+func (l *Link) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// connect handles a CONNECT command sent to t.
+func (l *Link) connect(t *TNC, src, dst string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	caller := l.index(t)
+	peer := l.station(1 - caller)
+	l.end()
+	l.state, l.caller, l.bandwidth = "connecting", caller, t.Bandwidth()
+	session := l.session
+	delay := l.opts.ConnectTimeout
+	answered := peer.Listening() && peer.MyCall() == dst
+	if answered {
+		delay = 2*l.opts.Latency + l.opts.Turnaround
+	}
+	time.AfterFunc(delay, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.session != session || l.state != "connecting" {
+			return // Cancelled
+		}
+		if !answered {
+			l.end()
+			l.schedule(caller, 0, func() { t.linkEvent("DISCONNECTED", "", "") })
+			return
+		}
+		l.state = "connected"
+		cmd := fmt.Sprintf("CONNECTED %s %s %s", src, dst, l.bandwidth)
+		l.schedule(caller, 0, func() { t.linkEvent(cmd, "connected", dst) })
+		l.schedule(1-caller, 0, func() { peer.linkEvent(cmd, "connected", src) })
+	})
+}
+
+// disconnect handles a DISCONNECT or ABORT command sent to t.
+//
+// Like VARA, DISCONNECT first sends the data queued by t, while data queued by the remote station
+// is discarded. The remote station is notified after the link latency, when all data sent by t has
+// been delivered. ABORT discards all queued data, and disconnects t immediately.
+func (l *Link) disconnect(t *TNC, abort bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.index(t)
+	switch l.state {
+	case "connecting":
+		l.end()
+		l.schedule(i, 0, func() { t.linkEvent("DISCONNECTED", "", "") })
+	case "connected", "disconnecting":
+		switch {
+		case abort:
+			l.hangup(i, 0)
+		case l.state == "connected":
+			l.state, l.closer = "disconnecting", i
+			l.queue[1-i] = nil
+			if len(l.queue[i]) == 0 {
+				l.hangup(i, l.opts.Latency)
+			}
+		}
+	}
+}
+
+// hangup ends the connection, notifying station i after delay and the remote station after the
+// link latency. The caller must hold l.mu.
+func (l *Link) hangup(i int, delay time.Duration) {
+	l.end()
+	t, peer := l.station(i), l.station(1-i)
+	l.schedule(i, delay, func() { t.linkEvent("DISCONNECTED", "", "") })
+	l.schedule(1-i, l.opts.Latency, func() { peer.linkEvent("DISCONNECTED", "", "") })
+}
+
+// transmit queues data written by the modem connected to t.
+func (l *Link) transmit(t *TNC, p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.index(t)
+	if l.state != "connected" && (l.state != "disconnecting" || i != l.closer) {
+		return
+	}
+	l.queue[i] = append(l.queue[i], p...)
+	l.reportBuffer(i, true)
+	l.wakeup()
+}
+
+// wakeup wakes run to check for frames to send.
+func (l *Link) wakeup() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// reportBuffer sends BUFFER to station i, honoring BufferInterval unless force is set. The
+// caller must hold l.mu.
+func (l *Link) reportBuffer(i int, force bool) {
+	now := time.Now()
+	if !force && len(l.queue[i]) > 0 && now.Sub(l.lastBuffer[i]) < l.opts.BufferInterval {
+		return
+	}
+	l.lastBuffer[i] = now
+	l.station(i).SendCmd(fmt.Sprintf("BUFFER %d", len(l.queue[i])))
+}
+
+// next returns the station to send the next frame, alternating between the stations when both
+// have data queued, or -1 if there's nothing to send or the channel is busy. The caller must hold
+// l.mu.
+func (l *Link) next(last int) int {
+	if l.busy || (l.state != "connected" && l.state != "disconnecting") {
+		return -1
+	}
+	switch a, b := len(l.queue[0]) > 0, len(l.queue[1]) > 0; {
+	case a && b && last == 0:
+		return 1
+	case a:
+		return 0
+	case b:
+		return 1
+	}
+	return -1
+}
+
+func (l *Link) throughput(bandwidth string) int {
+	if n, ok := l.opts.Throughput[bandwidth]; ok {
+		return n
+	}
+	if n, ok := defaultThroughput[bandwidth]; ok {
+		return n
+	}
+	return defaultThroughput["2300"]
+}
+
+// run sends the queued data frame by frame.
+func (l *Link) run() {
+	last := -1
+	for {
+		l.mu.Lock()
+		i := l.next(last)
+		if i < 0 {
+			l.mu.Unlock()
+			select {
+			case <-l.wake:
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		session := l.session
+		n := len(l.queue[i])
+		if n > l.opts.FrameSize {
+			n = l.opts.FrameSize
+		}
+		airtime := time.Duration(n) * time.Second / time.Duration(l.throughput(l.bandwidth))
+		l.mu.Unlock()
+
+		if last >= 0 && i != last && !l.sleep(l.opts.Turnaround) {
+			return
+		}
+		last = i
+		t := l.station(i)
+		t.SendCmd("PTT ON")
+		if !l.sleep(airtime) {
+			return
+		}
+		t.SendCmd("PTT OFF")
+
+		l.mu.Lock()
+		switch {
+		case l.session != session:
+			// The connection ended meanwhile
+		case l.opts.Loss > 0 && l.rand.Float64() < l.opts.Loss:
+			if l.retries++; l.retries > l.opts.MaxRetries {
+				l.fail()
+			}
+		default:
+			l.retries = 0
+			frame := l.queue[i][:n:n]
+			l.queue[i] = l.queue[i][n:]
+			peer := l.station(1 - i)
+			l.schedule(1-i, l.opts.Latency, func() { peer.deliver(frame) })
+			t.transmitted(frame)
+			l.reportBuffer(i, false)
+			if l.state == "disconnecting" && len(l.queue[i]) == 0 {
+				l.hangup(i, l.opts.Latency)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
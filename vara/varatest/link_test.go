@@ -0,0 +1,205 @@
+package varatest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+func newLinkModems(t *testing.T, opts LinkOptions) (*Link, *vara.Modem, *vara.Modem) {
+	t.Helper()
+	link, err := NewLink(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { link.Close() })
+	var modems []*vara.Modem
+	for _, s := range []struct {
+		tnc  *TNC
+		call string
+	}{{link.A, "N0CALL"}, {link.B, "LA5NTA"}} {
+		config := s.tnc.ModemConfig()
+		config.Timing.LateDataWindow = 10 * time.Millisecond
+		config.Timing.WriteSettleTime = 10 * time.Millisecond
+		m, err := vara.NewModem("varahf", s.call, config)
+		if err != nil {
+			t.Fatalf("NewModem: %v", err)
+		}
+		t.Cleanup(func() { m.Close() })
+		modems = append(modems, m)
+	}
+	return link, modems[0], modems[1]
+}
+
+// connectLink dials b from a, returning both ends of the connection.
+func connectLink(ctx context.Context, t *testing.T, link *Link, a, b *vara.Modem) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := b.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if _, err := link.B.WaitCmd(ctx, "LISTEN ON"); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+		}
+		accepted <- conn
+	}()
+	conn, err := a.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.FailNow()
+	}
+	return conn, remote
+}
+
+func TestLink(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	fast := map[string]int{"2300": 1 << 20}
+
+	t.Run("transfer", func(t *testing.T) {
+		link, a, b := newLinkModems(t, LinkOptions{
+			Throughput: fast,
+			Latency:    2 * time.Millisecond,
+			Turnaround: 2 * time.Millisecond,
+			FrameSize:  256,
+			Loss:       0.2,
+			MaxRetries: 50,
+			Seed:       1,
+		})
+		conn, remote := connectLink(ctx, t, link, a, b)
+		if got := remote.RemoteAddr().String(); got != "N0CALL" {
+			t.Errorf("unexpected remote %q", got)
+		}
+
+		sent := bytes.Repeat([]byte("0123456789"), 400)
+		written := make(chan error, 1)
+		go func() {
+			if _, err := conn.Write(sent); err != nil {
+				written <- err
+				return
+			}
+			_, err := remote.Write([]byte("FF\r"))
+			written <- err
+		}()
+		got := make([]byte, len(sent))
+		if _, err := io.ReadFull(remote, got); err != nil || !bytes.Equal(got, sent) {
+			t.Fatalf("unexpected data received by LA5NTA: %v", err)
+		}
+		if err := <-written; err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if b, err := io.ReadAll(remote); err != nil || string(b) != "" {
+			t.Errorf("unexpected data after disconnect %q: %v", b, err)
+		}
+		if b := link.B.Received(); string(b) != "FF\r" {
+			t.Errorf("unexpected data sent by LA5NTA %q", b)
+		}
+	})
+
+	t.Run("not answered", func(t *testing.T) {
+		_, a, _ := newLinkModems(t, LinkOptions{ConnectTimeout: 50 * time.Millisecond})
+		if _, err := a.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"}); err == nil {
+			t.Error("expected dial to fail")
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		link, a, b := newLinkModems(t, LinkOptions{Throughput: fast})
+		conn, remote := connectLink(ctx, t, link, a, b)
+		defer conn.Close()
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if _, err := link.A.WaitReceived(ctx, 5); err != nil {
+			t.Fatal(err)
+		}
+		link.Fail()
+		if _, err := io.ReadAll(remote); err != nil {
+			t.Errorf("Read: %v", err)
+		}
+		if _, ok := link.B.Connected(); ok {
+			t.Error("expected link to be lost")
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		link, a, b := newLinkModems(t, LinkOptions{})
+		events, stop := b.Events()
+		defer stop()
+		for _, m := range []*vara.Modem{a, b} {
+			// Make sure both TNCs have accepted their modem.
+			if _, err := m.VersionContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := link.SetBusy(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitEvent(ctx, events, vara.EventBusy); err != nil {
+			t.Fatal(err)
+		}
+		if !b.Busy() {
+			t.Error("expected busy channel")
+		}
+	})
+
+	t.Run("deferred while busy", func(t *testing.T) {
+		link, a, b := newLinkModems(t, LinkOptions{Throughput: fast})
+		conn, remote := connectLink(ctx, t, link, a, b)
+		defer conn.Close()
+		if err := link.SetBusy(true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := link.A.Received(); len(got) != 0 {
+			t.Errorf("sent %q while busy", got)
+		}
+		if err := link.SetBusy(false); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(remote, got); err != nil || string(got) != "hello" {
+			t.Errorf("unexpected data received by LA5NTA %q: %v", got, err)
+		}
+	})
+
+	t.Run("disconnect flushes", func(t *testing.T) {
+		link, a, b := newLinkModems(t, LinkOptions{
+			Throughput: map[string]int{"2300": 20000},
+			FrameSize:  256,
+		})
+		conn, remote := connectLink(ctx, t, link, a, b)
+		sent := bytes.Repeat([]byte("0123456789"), 400)
+		if _, err := conn.Write(sent); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if got, err := io.ReadAll(remote); err != nil || !bytes.Equal(got, sent) {
+			t.Errorf("received %d of %d bytes before disconnect: %v", len(got), len(sent), err)
+		}
+	})
+}
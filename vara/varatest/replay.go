@@ -0,0 +1,347 @@
+// Package varatest provides fakes of the VARA modem program for testing code using package vara,
+// without the VARA binary.
+package varatest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+// ReplayOptions configures a Replay.
+type ReplayOptions struct {
+	// Speed scales the delays between records sent to the modem: 1 plays the trace in real time, 10
+	// plays it ten times faster. Zero sends records without delay.
+	Speed float64
+	// Timeout is how long to wait for each record expected from the modem; defaults to 5 seconds
+	Timeout time.Duration
+	// IgnoreCmds lists prefixes of commands sent by the modem that are not asserted. They're
+	// skipped both in the trace and when received.
+	IgnoreCmds []string
+}
+
+// Replay plays a trace captured by vara.ModemConfig.Capture back as a fake VARA TNC.
+//
+// Records received by the modem (C< and D<) are sent in order, honoring their relative timing.
+// Since commands and data are sent on independent TCP connections, the modem may still read them
+// in a different order, e.g. data before the CONNECTED preceding it in the trace; the replay is
+// not deterministic in that regard, just like VARA.
+//
+// Records sent by the modem (C> and D>) are expected in order: the replay blocks until they're
+// received, and fails on any mismatch. Data is compared as a stream, regardless of how it was
+// chunked. After the end of the trace, anything else sent by the modem before it closes the
+// connections is a mismatch too. When the replay fails, the connections are closed, so the modem
+// sees the TNC go away rather than waiting forever.
+type Replay struct {
+	records []vara.CaptureRecord
+	opts    ReplayOptions
+	cmdLn   net.Listener
+	dataLn  net.Listener
+
+	cmds chan string // Commands received from the modem
+	data chan []byte // Data received from the modem
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	done   chan struct{} // Closed when the replay is done
+	err    error
+	closed chan struct{} // Closed by Close
+	once   sync.Once
+}
+
+// ReadCaptureFile reads all records of the capture file at path.
+func ReadCaptureFile(path string) ([]vara.CaptureRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vara.NewCaptureReader(f).ReadAll()
+}
+
+// NewReplay starts a replay of records, listening on ephemeral ports on localhost.
+//
+// The replay starts when the modem has connected to both ports.
+func NewReplay(records []vara.CaptureRecord, opts ReplayOptions) (*Replay, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	cmdLn, dataLn, err := listenPair()
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{
+		opts:   opts,
+		cmdLn:  cmdLn,
+		dataLn: dataLn,
+		cmds:   make(chan string, 64),
+		data:   make(chan []byte, 64),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	for _, rec := range records {
+		if rec.Tag == vara.CaptureCmdOut && r.ignored(string(rec.Payload)) {
+			continue
+		}
+		r.records = append(r.records, rec)
+	}
+	go r.run()
+	return r, nil
+}
+
+// listenPair listens on two ephemeral ports on localhost, for the command and data ports.
+func listenPair() (cmdLn, dataLn net.Listener, err error) {
+	if cmdLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, nil, err
+	}
+	if dataLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		cmdLn.Close()
+		return nil, nil, err
+	}
+	return cmdLn, dataLn, nil
+}
+
+func port(ln net.Listener) int { return ln.Addr().(*net.TCPAddr).Port }
+
+// ModemConfig returns a vara.ModemConfig for connecting to the replay.
+func (r *Replay) ModemConfig() vara.ModemConfig {
+	return vara.ModemConfig{Host: "127.0.0.1", CmdPort: port(r.cmdLn), DataPort: port(r.dataLn)}
+}
+
+// Wait blocks until the whole trace has been played and the modem has closed the connections (or
+// the replay is closed), returning the first mismatch or timeout. Close the modem before calling
+// Wait.
+func (r *Replay) Wait() error {
+	<-r.done
+	return r.err
+}
+
+// Close stops the replay, closing the connections with the modem.
+func (r *Replay) Close() error {
+	r.once.Do(func() {
+		close(r.closed)
+		r.cmdLn.Close()
+		r.dataLn.Close()
+		r.closeConns()
+	})
+	<-r.done
+	return nil
+}
+
+func (r *Replay) ignored(cmd string) bool {
+	for _, prefix := range r.opts.IgnoreCmds {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replay) accept(ln net.Listener) (net.Conn, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.conns = append(r.conns, conn)
+	r.mu.Unlock()
+	return conn, nil
+}
+
+func (r *Replay) run() {
+	defer close(r.done)
+	cmdConn, err := r.accept(r.cmdLn)
+	if err != nil {
+		r.err = fmt.Errorf("accepting command connection: %w", err)
+		return
+	}
+	dataConn, err := r.accept(r.dataLn)
+	if err != nil {
+		r.err = fmt.Errorf("accepting data connection: %w", err)
+		return
+	}
+	go r.readCmds(cmdConn)
+	go r.readData(dataConn)
+	if r.err = r.play(cmdConn, dataConn); r.err == nil {
+		r.err = r.trailing()
+	}
+	if r.err != nil {
+		// Don't leave the modem waiting for records that will never come.
+		r.closeConns()
+	}
+}
+
+func (r *Replay) closeConns() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+}
+
+func (r *Replay) readCmds(conn net.Conn) {
+	defer close(r.cmds)
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := rd.ReadString('\r')
+		if err != nil {
+			return
+		}
+		if cmd = strings.TrimSuffix(cmd, "\r"); r.ignored(cmd) {
+			continue
+		}
+		select {
+		case r.cmds <- cmd:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+func (r *Replay) readData(conn net.Conn) {
+	defer close(r.data)
+	for {
+		buf := make([]byte, 1<<16)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			select {
+			case r.data <- buf[:n]:
+			case <-r.closed:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *Replay) play(cmdConn, dataConn net.Conn) error {
+	var data []byte // Received data not yet matched
+	var prev time.Time
+	for i, rec := range r.records {
+		switch rec.Tag {
+		case vara.CaptureCmdIn, vara.CaptureDataIn:
+			if err := r.sleep(rec.Time, prev); err != nil {
+				return err
+			}
+			conn, p := dataConn, rec.Payload
+			if rec.Tag.IsCmd() {
+				conn, p = cmdConn, append(p[:len(p):len(p)], '\r')
+			}
+			if _, err := conn.Write(p); err != nil {
+				return fmt.Errorf("record %d: sending %s: %w", i, rec.Tag, err)
+			}
+		case vara.CaptureCmdOut:
+			cmd, err := r.receiveCmd()
+			if err != nil {
+				return fmt.Errorf("record %d: expected command %q: %w", i, rec.Payload, err)
+			}
+			if cmd != string(rec.Payload) {
+				return fmt.Errorf("record %d: expected command %q, got %q", i, rec.Payload, cmd)
+			}
+		case vara.CaptureDataOut:
+			for len(data) < len(rec.Payload) {
+				p, err := r.receiveData()
+				if err != nil {
+					return fmt.Errorf("record %d: expected %d bytes of data, got %d: %w", i, len(rec.Payload), len(data), err)
+				}
+				data = append(data, p...)
+			}
+			if !bytes.Equal(data[:len(rec.Payload)], rec.Payload) {
+				return fmt.Errorf("record %d: expected data %q, got %q", i, rec.Payload, data[:len(rec.Payload)])
+			}
+			data = data[len(rec.Payload):]
+		default:
+			return fmt.Errorf("record %d: unknown tag %q", i, rec.Tag)
+		}
+		prev = rec.Time
+	}
+	if len(data) > 0 {
+		return fmt.Errorf("unexpected data %q after the end of the trace", data)
+	}
+	return nil
+}
+
+// trailing waits for the modem to close the connections, failing on anything received after the end
+// of the trace.
+func (r *Replay) trailing() error {
+	cmds, data := r.cmds, r.data
+	for cmds != nil || data != nil {
+		select {
+		case cmd, ok := <-cmds:
+			if !ok {
+				cmds = nil
+				continue
+			}
+			return fmt.Errorf("unexpected command %q after the end of the trace", cmd)
+		case p, ok := <-data:
+			if !ok {
+				data = nil
+				continue
+			}
+			return fmt.Errorf("unexpected data %q after the end of the trace", p)
+		case <-r.closed:
+			return nil
+		}
+	}
+	return nil
+}
+
+// sleep waits for the delay between two records, scaled by the replay speed.
+func (r *Replay) sleep(t, prev time.Time) error {
+	if r.opts.Speed == 0 || prev.IsZero() || !t.After(prev) {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(float64(t.Sub(prev)) / r.opts.Speed))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.closed:
+		return errors.New("replay closed")
+	}
+}
+
+// receiveCmd waits for the next command from the modem.
+func (r *Replay) receiveCmd() (string, error) {
+	timeout := time.NewTimer(r.opts.Timeout)
+	defer timeout.Stop()
+	select {
+	case cmd, ok := <-r.cmds:
+		if !ok {
+			return "", io.EOF
+		}
+		return cmd, nil
+	case <-timeout.C:
+		return "", fmt.Errorf("timeout after %s", r.opts.Timeout)
+	case <-r.closed:
+		return "", errors.New("replay closed")
+	}
+}
+
+// receiveData waits for the next chunk of data from the modem.
+func (r *Replay) receiveData() ([]byte, error) {
+	timeout := time.NewTimer(r.opts.Timeout)
+	defer timeout.Stop()
+	select {
+	case p, ok := <-r.data:
+		if !ok {
+			return nil, io.EOF
+		}
+		return p, nil
+	case <-timeout.C:
+		return nil, fmt.Errorf("timeout after %s", r.opts.Timeout)
+	case <-r.closed:
+		return nil, errors.New("replay closed")
+	}
+}
@@ -0,0 +1,80 @@
+package varatest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+const dialTrace = `# vara-capture 1 varafm N0CALL
+2024-01-02T03:04:05Z C> MYCALL N0CALL
+2024-01-02T03:04:05Z C> LISTEN OFF
+2024-01-02T03:04:06Z C> CONNECT N0CALL LA5NTA
+2024-01-02T03:04:09Z C< CONNECTED N0CALL LA5NTA WIDE
+2024-01-02T03:04:10Z D> aGVsbG8=
+2024-01-02T03:04:10Z C< BUFFER 5
+2024-01-02T03:04:12Z C< BUFFER 0
+2024-01-02T03:04:13Z D< d29ybGQ=
+2024-01-02T03:04:14Z C< DISCONNECTED
+`
+
+func replayDial(t *testing.T, trace, target string) error {
+	recs, err := vara.NewCaptureReader(strings.NewReader(trace)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err := NewReplay(recs, ReplayOptions{
+		Speed:      100,
+		Timeout:    time.Second,
+		IgnoreCmds: []string{"PUBLIC", "COMPRESSION", "VERSION"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rp.Close()
+
+	config := rp.ModemConfig()
+	config.Timing.LateDataWindow = 10 * time.Millisecond
+	m, err := vara.NewModem("varafm", "N0CALL", config)
+	if err != nil {
+		t.Fatalf("NewModem: %v", err)
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varafm", Target: target})
+	if err != nil {
+		m.Close()
+		return rp.Wait()
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || string(b) != "world" {
+		t.Errorf("unexpected data %q: %v", b, err)
+	}
+	// Anything sent after the end of the trace is a mismatch too.
+	m.Close()
+	return rp.Wait()
+}
+
+func TestReplay(t *testing.T) {
+	if err := replayDial(t, dialTrace, "LA5NTA"); err != nil {
+		t.Errorf("replay failed: %v", err)
+	}
+	if err := replayDial(t, dialTrace, "N0CALL-1"); err == nil || !strings.Contains(err.Error(), `expected command "CONNECT N0CALL LA5NTA"`) {
+		t.Errorf("expected command mismatch, got %v", err)
+	}
+	// The trace ends before the dial.
+	trace := dialTrace[:strings.Index(dialTrace, "2024-01-02T03:04:06Z")]
+	if err := replayDial(t, trace, "LA5NTA"); err == nil || !strings.Contains(err.Error(), `unexpected command "CONNECT N0CALL LA5NTA" after the end of the trace`) {
+		t.Errorf("expected trailing command mismatch, got %v", err)
+	}
+}
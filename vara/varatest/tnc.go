@@ -0,0 +1,526 @@
+package varatest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+// ErrNotConnected is returned when sending data or disconnecting while no link is established.
+var ErrNotConnected = errors.New("not connected")
+
+// TNCOptions configures a TNC.
+type TNCOptions struct {
+	// Bandwidth is reported in CONNECTED until changed by a BW command; defaults to "2300"
+	Bandwidth string
+	// AcceptFunc decides whether an outbound connection to dst is answered; optional, all
+	// connections are answered by default
+	AcceptFunc func(src, dst string) bool
+	// ConnectDelay is the time between CONNECT and CONNECTED (or DISCONNECTED if not answered)
+	ConnectDelay time.Duration
+	// TxDelay is the time it takes to transmit data written by the modem, between the BUFFER
+	// reporting it and the BUFFER 0 acknowledging it
+	TxDelay time.Duration
+	// AliveInterval is how often IAMALIVE is sent; zero disables it
+	AliveInterval time.Duration
+}
+
+// TNC is a fake VARA modem program, speaking the native TNC protocol on ephemeral ports on
+// localhost.
+//
+// It answers commands from the modem (OK, or WRONG for unknown commands), simulates outbound
+// links and the transmission of written data (BUFFER, PTT), and is scripted by the test to
+// simulate the remote station (Inbound, Send, Disconnect) and the channel (SetBusy).
+type TNC struct {
+	opts   TNCOptions
+	cmdLn  net.Listener
+	dataLn net.Listener
+	done   chan struct{}
+	once   sync.Once
+	link   *Link // Set if the TNC is one end of a simulated link
+
+	mu          sync.Mutex
+	changed     chan struct{} // Closed (and replaced) when a command or data is received
+	cmdConn     net.Conn
+	dataConn    net.Conn
+	myCall      string
+	listening   bool
+	bandwidth   string
+	state       string // "", "connecting" or "connected"
+	remoteCall  string
+	connectTime *time.Timer
+	pending     int // Bytes in the TX buffer
+	cmds        []string
+	cmdCursor   int // Commands before this index were already matched by WaitCmd
+	received    []byte
+}
+
+// NewTNC starts a fake TNC.
+func NewTNC(opts TNCOptions) (*TNC, error) { return newTNC(opts, nil) }
+
+func newTNC(opts TNCOptions, link *Link) (*TNC, error) {
+	if opts.Bandwidth == "" {
+		opts.Bandwidth = "2300"
+	}
+	cmdLn, dataLn, err := listenPair()
+	if err != nil {
+		return nil, err
+	}
+	t := &TNC{
+		opts:      opts,
+		cmdLn:     cmdLn,
+		dataLn:    dataLn,
+		done:      make(chan struct{}),
+		link:      link,
+		changed:   make(chan struct{}),
+		bandwidth: opts.Bandwidth,
+	}
+	go t.acceptCmd()
+	go t.acceptData()
+	if opts.AliveInterval > 0 {
+		go t.keepAlive()
+	}
+	return t, nil
+}
+
+// ModemConfig returns a vara.ModemConfig for connecting to the TNC.
+func (t *TNC) ModemConfig() vara.ModemConfig {
+	return vara.ModemConfig{Host: "127.0.0.1", CmdPort: port(t.cmdLn), DataPort: port(t.dataLn)}
+}
+
+// Close stops the TNC, closing the connections with the modem.
+func (t *TNC) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+		t.cmdLn.Close()
+		t.dataLn.Close()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, c := range []net.Conn{t.cmdConn, t.dataConn} {
+			if c != nil {
+				c.Close()
+			}
+		}
+		if t.connectTime != nil {
+			t.connectTime.Stop()
+		}
+	})
+	return nil
+}
+
+// MyCall returns the callsign set by the modem.
+func (t *TNC) MyCall() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.myCall
+}
+
+// Listening returns true if the modem enabled inbound connections.
+func (t *TNC) Listening() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.listening
+}
+
+// Bandwidth returns the current bandwidth.
+func (t *TNC) Bandwidth() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bandwidth
+}
+
+// Connected returns the remote callsign if a link is established.
+func (t *TNC) Connected() (remoteCall string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.remoteCall, t.state == "connected"
+}
+
+// Commands returns all commands received from the modem.
+func (t *TNC) Commands() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.cmds...)
+}
+
+// Received returns all data received from the modem, as transmitted to the remote station.
+func (t *TNC) Received() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte(nil), t.received...)
+}
+
+// WaitCmd waits for a command with the given prefix, returning it. Each command is only matched
+// once, and commands received before the last match are skipped.
+func (t *TNC) WaitCmd(ctx context.Context, prefix string) (string, error) {
+	for {
+		t.mu.Lock()
+		for i := t.cmdCursor; i < len(t.cmds); i++ {
+			if strings.HasPrefix(t.cmds[i], prefix) {
+				t.cmdCursor = i + 1
+				t.mu.Unlock()
+				return t.cmds[i], nil
+			}
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		if err := t.wait(ctx, changed); err != nil {
+			return "", err
+		}
+	}
+}
+
+// WaitReceived waits until at least n bytes of data have been received from the modem, returning
+// all data received.
+func (t *TNC) WaitReceived(ctx context.Context, n int) ([]byte, error) {
+	for {
+		t.mu.Lock()
+		if len(t.received) >= n {
+			defer t.mu.Unlock()
+			return append([]byte(nil), t.received...), nil
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		if err := t.wait(ctx, changed); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *TNC) wait(ctx context.Context, changed chan struct{}) error {
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.done:
+		return errors.New("TNC closed")
+	}
+}
+
+// SendCmd sends a raw command to the modem.
+func (t *TNC) SendCmd(cmd string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sendCmd(cmd)
+}
+
+// sendCmd sends a command to the modem. The caller must hold t.mu.
+func (t *TNC) sendCmd(cmd string) error {
+	if t.cmdConn == nil {
+		return errors.New("modem not connected")
+	}
+	_, err := t.cmdConn.Write([]byte(cmd + "\r"))
+	return err
+}
+
+// SetBusy simulates the channel becoming busy or clear.
+func (t *TNC) SetBusy(busy bool) error {
+	if busy {
+		return t.SendCmd("BUSY ON")
+	}
+	return t.SendCmd("BUSY OFF")
+}
+
+// Inbound simulates an inbound connection from the remote station. It fails if the modem is not
+// listening or a link is already established.
+func (t *TNC) Inbound(remoteCall string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case !t.listening:
+		return errors.New("modem not listening")
+	case t.state != "":
+		return errors.New("modem busy")
+	}
+	t.state, t.remoteCall = "connected", remoteCall
+	return t.sendCmd(fmt.Sprintf("CONNECTED %s %s %s", remoteCall, t.myCall, t.bandwidth))
+}
+
+// Send simulates data received from the remote station.
+func (t *TNC) Send(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != "connected" || t.dataConn == nil {
+		return ErrNotConnected
+	}
+	_, err := t.dataConn.Write(p)
+	return err
+}
+
+// WriteData writes p to the modem's data port, regardless of the link state. It's used to
+// simulate data racing the command port, e.g. data sent right after CONNECTED being read first.
+func (t *TNC) WriteData(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dataConn == nil {
+		return errors.New("modem not connected")
+	}
+	_, err := t.dataConn.Write(p)
+	return err
+}
+
+// Disconnect simulates the remote station (or VARA) disconnecting the link.
+func (t *TNC) Disconnect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == "" {
+		return ErrNotConnected
+	}
+	return t.disconnected()
+}
+
+// disconnected ends the link. The caller must hold t.mu.
+func (t *TNC) disconnected() error {
+	if t.connectTime != nil {
+		t.connectTime.Stop()
+		t.connectTime = nil
+	}
+	t.state, t.remoteCall, t.pending = "", "", 0
+	return t.sendCmd("DISCONNECTED")
+}
+
+// Drop closes the connections with the modem, as if the VARA modem program was restarted. Any link
+// is lost and listening is turned off, but the modem may connect again.
+func (t *TNC) Drop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range []net.Conn{t.cmdConn, t.dataConn} {
+		if c != nil {
+			c.Close()
+		}
+	}
+	if t.connectTime != nil {
+		t.connectTime.Stop()
+	}
+	t.cmdConn, t.dataConn = nil, nil
+	t.listening, t.state, t.remoteCall, t.pending = false, "", "", 0
+	t.notify()
+}
+
+func (t *TNC) acceptCmd() {
+	for {
+		conn, err := t.cmdLn.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.cmdConn != nil {
+			t.cmdConn.Close()
+		}
+		t.cmdConn = conn
+		t.mu.Unlock()
+		go t.readCmds(conn)
+	}
+}
+
+func (t *TNC) acceptData() {
+	for {
+		conn, err := t.dataLn.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.dataConn != nil {
+			t.dataConn.Close()
+		}
+		t.dataConn = conn
+		t.mu.Unlock()
+		go t.readData(conn)
+	}
+}
+
+func (t *TNC) keepAlive() {
+	ticker := time.NewTicker(t.opts.AliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.SendCmd("IAMALIVE")
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// notify wakes up WaitCmd and WaitReceived. The caller must hold t.mu.
+func (t *TNC) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *TNC) readCmds(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	for {
+		cmd, err := rd.ReadString('\r')
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		cmd = strings.TrimSuffix(cmd, "\r")
+		t.cmds = append(t.cmds, cmd)
+		after := t.handleCmd(cmd)
+		t.notify()
+		t.mu.Unlock()
+		if after != nil {
+			after() // Calls into the link, which must not happen with t.mu held
+		}
+	}
+}
+
+// handleCmd handles a command from the modem, returning a function to call once t.mu is released.
+// The caller must hold t.mu.
+func (t *TNC) handleCmd(cmd string) (after func()) {
+	parts := strings.Fields(cmd)
+	if len(parts) == 0 {
+		t.sendCmd("WRONG")
+		return
+	}
+	switch {
+	case parts[0] == "MYCALL" && len(parts) > 1:
+		t.myCall = parts[1]
+	case cmd == "LISTEN ON":
+		t.listening = true
+	case cmd == "LISTEN OFF":
+		t.listening = false
+	case strings.HasPrefix(cmd, "BW") && len(parts) == 1 && len(cmd) > 2:
+		t.bandwidth = cmd[2:]
+	case cmd == "VERSION":
+		t.sendCmd("VERSION varatest")
+		return
+	case parts[0] == "CONNECT" && len(parts) >= 3:
+		if t.state != "" {
+			t.sendCmd("WRONG")
+			return
+		}
+		t.sendCmd("OK")
+		if t.link != nil {
+			t.state, t.remoteCall = "connecting", parts[2]
+			return func() { t.link.connect(t, parts[1], parts[2]) }
+		}
+		t.connect(parts[1], parts[2])
+		return
+	case cmd == "DISCONNECT", cmd == "ABORT":
+		t.sendCmd("OK")
+		if t.link != nil {
+			return func() { t.link.disconnect(t, cmd == "ABORT") }
+		}
+		if t.state != "" {
+			t.disconnected()
+		}
+		return
+	case cmd == "PUBLIC ON", cmd == "PUBLIC OFF",
+		cmd == "CWID ON", cmd == "CWID OFF",
+		cmd == "CHAT ON", cmd == "CHAT OFF",
+		cmd == "WINLINK SESSION", cmd == "P2P SESSION",
+		parts[0] == "COMPRESSION":
+	default:
+		t.sendCmd("WRONG")
+		return
+	}
+	t.sendCmd("OK")
+	return
+}
+
+// connect simulates dialing dst. The caller must hold t.mu.
+func (t *TNC) connect(src, dst string) {
+	t.state, t.remoteCall = "connecting", dst
+	var timer *time.Timer
+	timer = time.AfterFunc(t.opts.ConnectDelay, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.connectTime != timer || t.state != "connecting" {
+			return // Cancelled
+		}
+		t.connectTime = nil
+		if fn := t.opts.AcceptFunc; fn != nil && !fn(src, dst) {
+			t.disconnected()
+			return
+		}
+		t.state = "connected"
+		t.sendCmd(fmt.Sprintf("CONNECTED %s %s %s", src, dst, t.bandwidth))
+	})
+	t.connectTime = timer
+}
+
+func (t *TNC) readData(conn net.Conn) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			t.mu.Lock()
+			after := t.transmit(buf[:n])
+			t.notify()
+			t.mu.Unlock()
+			if after != nil {
+				after()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// transmit simulates transmission of data written by the modem, returning a function to call once
+// t.mu is released. The caller must hold t.mu.
+func (t *TNC) transmit(p []byte) (after func()) {
+	if t.state != "connected" {
+		return // VARA discards data written while disconnected
+	}
+	if t.link != nil {
+		p = append([]byte(nil), p...)
+		return func() { t.link.transmit(t, p) }
+	}
+	t.pending += len(p)
+	t.sendCmd(fmt.Sprintf("BUFFER %d", t.pending))
+	t.sendCmd("PTT ON")
+	p = append([]byte(nil), p...)
+	time.AfterFunc(t.opts.TxDelay, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.state != "connected" {
+			return
+		}
+		t.received = append(t.received, p...)
+		if t.pending -= len(p); t.pending <= 0 {
+			t.pending = 0
+			t.sendCmd("PTT OFF")
+		}
+		t.sendCmd(fmt.Sprintf("BUFFER %d", t.pending))
+		t.notify()
+	})
+	return
+}
+
+// linkEvent sends cmd to the modem, updating the link state of a TNC attached to a Link.
+func (t *TNC) linkEvent(cmd, state, remoteCall string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state, t.remoteCall, t.pending = state, remoteCall, 0
+	t.sendCmd(cmd)
+}
+
+// deliver writes data received over a Link to the modem, unless the link was lost meanwhile.
+func (t *TNC) deliver(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == "connected" && t.dataConn != nil {
+		t.dataConn.Write(p)
+	}
+}
+
+// transmitted records data transmitted over a Link.
+func (t *TNC) transmitted(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.received = append(t.received, p...)
+	t.notify()
+}
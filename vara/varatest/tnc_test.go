@@ -0,0 +1,133 @@
+package varatest
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/la5nta/wl2k-go/transport"
+	"github.com/n8jja/Pat-Vara/vara"
+)
+
+func newTNCModem(t *testing.T, opts TNCOptions) (*TNC, *vara.Modem) {
+	t.Helper()
+	tnc, err := NewTNC(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tnc.Close() })
+	config := tnc.ModemConfig()
+	config.Timing.LateDataWindow = 10 * time.Millisecond
+	m, err := vara.NewModem("varahf", "N0CALL", config)
+	if err != nil {
+		t.Fatalf("NewModem: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return tnc, m
+}
+
+func TestTNC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("dial", func(t *testing.T) {
+		tnc, m := newTNCModem(t, TNCOptions{TxDelay: 10 * time.Millisecond})
+		if v, err := m.VersionContext(ctx); err != nil || v != "varatest" {
+			t.Errorf("VERSION: got %q: %v", v, err)
+		}
+		if got := tnc.MyCall(); got != "N0CALL" {
+			t.Errorf("MYCALL: got %q", got)
+		}
+		conn, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"})
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if remote, ok := tnc.Connected(); !ok || remote != "LA5NTA" {
+			t.Errorf("expected link to LA5NTA, got %q", remote)
+		}
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if b, err := tnc.WaitReceived(ctx, 5); err != nil || string(b) != "hello" {
+			t.Errorf("unexpected data received by TNC %q: %v", b, err)
+		}
+		if err := tnc.Send([]byte("world")); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if err := tnc.Disconnect(); err != nil {
+			t.Fatalf("Disconnect: %v", err)
+		}
+		if b, err := io.ReadAll(conn); err != nil || string(b) != "world" {
+			t.Errorf("unexpected data received by modem %q: %v", b, err)
+		}
+		conn.Close()
+	})
+
+	t.Run("not answered", func(t *testing.T) {
+		_, m := newTNCModem(t, TNCOptions{AcceptFunc: func(src, dst string) bool { return false }})
+		if _, err := m.DialURLContext(ctx, &transport.URL{Scheme: "varahf", Target: "LA5NTA"}); err == nil {
+			t.Error("expected dial to fail")
+		}
+	})
+
+	t.Run("inbound", func(t *testing.T) {
+		tnc, m := newTNCModem(t, TNCOptions{})
+		ln, err := m.Listen()
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		defer ln.Close()
+		if _, err := tnc.WaitCmd(ctx, "LISTEN ON"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tnc.Inbound("LA5NTA"); err != nil {
+			t.Fatalf("Inbound: %v", err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if got := conn.RemoteAddr().String(); got != "LA5NTA" {
+			t.Errorf("unexpected remote %q", got)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+		if _, err := tnc.WaitCmd(ctx, "DISCONNECT"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		tnc, m := newTNCModem(t, TNCOptions{})
+		events, stop := m.Events()
+		defer stop()
+		if err := tnc.SetBusy(true); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitEvent(ctx, events, vara.EventBusy); err != nil {
+			t.Fatal(err)
+		}
+		if !m.Busy() {
+			t.Error("expected busy channel")
+		}
+	})
+}
+
+// waitEvent waits for an event of the given type.
+func waitEvent(ctx context.Context, events <-chan vara.Event, typ vara.EventType) error {
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return io.EOF
+			}
+			if ev.Type == typ {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}